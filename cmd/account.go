@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	address string
+)
+
+func init() {
+	accountCmd.Flags().StringVarP(&address, "address", "a", "", "Address (b58) or name of the account to query")
+	accountCmd.Flags().Uint64VarP(&blockHeight, "blockHeight", "b", 0, "Block height of the queried state (default latest)")
+	accountCmd.MarkFlagRequired("address")
+	rootCmd.AddCommand(accountCmd)
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Get the state of an account",
+	Run:   execAccount,
+}
+
+func execAccount(cmd *cobra.Command, args []string) {
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+	// check db path and open db
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	addr, err := types.DecodeAddress(address)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	trieKey := types.ToAccountID(addr)
+
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	rootBytes, err := getHeightTrieRoot(chainStore, blockHeight)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	tr := stool.NewTrieReader(store, false)
+	state, err := tr.Get(rootBytes, trieKey[:])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("\nQuerying account in state root: ", base58.Encode(rootBytes))
+	if state == nil {
+		fmt.Println("Account not found in the state trie")
+		return
+	}
+	displayAccount(address, state)
+}
+
+func displayAccount(address string, state *types.State) {
+	fmt.Println("\nAccount state:")
+	fmt.Println("==============")
+	fmt.Println("* Address: ", address)
+	fmt.Println("* Balance: ", new(big.Int).SetBytes(state.GetBalance()))
+	fmt.Println("* Nonce: ", state.GetNonce())
+	fmt.Println("* Code hash: ", base58.Encode(state.GetCodeHash()))
+	fmt.Println("* Storage root: ", base58.Encode(state.GetStorageRoot()))
+	fmt.Println("* SQL recovery point: ", state.GetSqlRecoveryPoint())
+}
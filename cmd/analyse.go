@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"time"
 
 	"github.com/aergoio/aergo-lib/db"
@@ -17,12 +20,20 @@ var (
 	contractTrie bool
 	root         string
 	blockHeight  uint64
+	startKey     string
+	endKey       string
+	keyPrefix    string
+	reportPath   string
+	layerPaths   []string
 )
 
 func init() {
 	analyseCmd.Flags().BoolVar(&contractTrie, "contractTrie", false, "The trie being queried is a contract trie")
 	analyseCmd.Flags().StringVarP(&root, "root", "r", "", "Root of the Aergo trie to analyse")
 	analyseCmd.Flags().Uint64VarP(&blockHeight, "blockHeight", "b", 0, "Block height to analyse")
+	analyseCmd.Flags().StringVar(&reportPath, "report", "", "Path/to/report.json: record all the integrity failures instead of stopping at the first one")
+	analyseCmd.Flags().StringSliceVar(&layerPaths, "layers", nil, "Path/to/data/folders whose state is read in order when a node is missing from dbPath (e.g. the base snapshot of a delta)")
+	addKeyRangeFlags(analyseCmd)
 	rootCmd.AddCommand(analyseCmd)
 }
 
@@ -39,6 +50,12 @@ func execAnalyse(cmd *cobra.Command, args []string) {
 		fmt.Println("Invalid database path provided")
 		return
 	}
+	for _, layerPath := range layerPaths {
+		if stat, err := os.Stat(path.Join(layerPath, "state")); err != nil || !stat.IsDir() {
+			fmt.Println("The layer ", layerPath, " doesn't contain a state database")
+			return
+		}
+	}
 	store := db.NewDB(db.BadgerImpl, statePath)
 
 	if len(root) != 0 && blockHeight != 0 {
@@ -50,12 +67,17 @@ func execAnalyse(cmd *cobra.Command, args []string) {
 		return
 	}
 
+	keyRange, err := getKeyRange()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	chainPath := path.Join(dbPath, "chain")
 	chainStore := db.NewDB(db.BadgerImpl, chainPath)
 
 	// Get state root
 	var rootBytes []byte
-	var err error
 	if len(root) != 0 {
 		rootBytes, err = base58.Decode(root)
 		if err != nil {
@@ -81,18 +103,66 @@ func execAnalyse(cmd *cobra.Command, args []string) {
 
 	fmt.Println("\nAnalysing state with root: ", base58.Encode(rootBytes))
 	start := time.Now()
-	sa := stool.NewStateAnalysis(store, countDBReads, !contractTrie, integrityCheck, 10000)
+	sa := stool.NewStateAnalysis(store, countDBReads, !contractTrie, integrityCheck, workers)
+	sa.SetKeyRange(keyRange)
+	var layers []db.DB
+	for _, layerPath := range layerPaths {
+		layers = append(layers, db.NewDB(db.BadgerImpl, path.Join(layerPath, "state")))
+	}
+	sa.AddLayers(layers...)
+	defer func() {
+		for _, layer := range layers {
+			layer.Close()
+		}
+	}()
+	if len(reportPath) != 0 {
+		sa.CollectIntegrityFailures()
+	}
 	err = sa.Analyse(rootBytes)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	fmt.Printf("Time to analyse: %v\n", time.Since(start))
-	if integrityCheck {
+	store.Close()
+	if len(reportPath) != 0 {
+		err = writeIntegrityReport(reportPath, sa.IntegrityReport(rootBytes))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if integrityCheck {
 		fmt.Println("Integrity check: pass")
 	}
-	store.Close()
 
 	displayResults(sa, contractTrie)
 	displayFolderSizes(dbPath, "Current latest state size information:")
 }
+
+// writeIntegrityReport writes the integrity failures of a state to a json file
+// and displays their number per kind
+func writeIntegrityReport(reportPath string, report *stool.IntegrityReport) error {
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(reportPath, raw, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Integrity report written to: ", reportPath)
+	var kinds []string
+	for kind := range report.NbFailures {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Println("* Number of ", kind, " failures: ", report.NbFailures[kind])
+	}
+	if len(report.Failures) != 0 {
+		fmt.Println("Integrity check: failed")
+	} else {
+		fmt.Println("Integrity check: pass")
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var deltaPath string
+
+func init() {
+	applyDeltaCmd.Flags().StringVarP(&snapshotPath, "snapshotPath", "s", "", "Path/to/snapshot/folder/data")
+	applyDeltaCmd.Flags().StringVar(&deltaPath, "delta", "", "Path/to/delta/snapshot/folder created by snapshot --base")
+	applyDeltaCmd.MarkFlagRequired("snapshotPath")
+	applyDeltaCmd.MarkFlagRequired("delta")
+	rootCmd.AddCommand(applyDeltaCmd)
+}
+
+var applyDeltaCmd = &cobra.Command{
+	Use:   "apply-delta",
+	Short: "Add a delta snapshot to the snapshot of its base root and verify the new state",
+	Run:   execApplyDelta,
+}
+
+func execApplyDelta(cmd *cobra.Command, args []string) {
+	// check snapshot and delta paths
+	if stat, err := os.Stat(snapshotPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid path for snapshot database provided")
+		return
+	}
+	if stat, err := os.Stat(deltaPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid path for delta snapshot provided")
+		return
+	}
+	dm, err := readManifest(deltaPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if dm == nil || len(dm.Base) == 0 {
+		fmt.Println("The delta folder doesn't contain a delta snapshot manifest")
+		return
+	}
+	baseRoot, err := base58.Decode(dm.Base)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	root, err := base58.Decode(dm.StateRoot)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var voteRoots [][]byte
+	for _, voteRoot := range dm.VoteRoots {
+		raw, err := base58.Decode(voteRoot)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		voteRoots = append(voteRoots, raw)
+	}
+
+	// the snapshot must contain the whole state of the base root
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if m != nil && (m.KeyRange != nil || len(m.Base) != 0 || (len(m.Format) != 0 && m.Format != badgerFormat)) {
+		fmt.Println("A delta can only be applied to a complete badger snapshot")
+		return
+	}
+	statePath := path.Join(snapshotPath, "state")
+	chainPath := path.Join(snapshotPath, "chain")
+	if stat, err := os.Stat(statePath); err != nil || !stat.IsDir() {
+		fmt.Println("The snapshot doesn't contain a state database")
+		return
+	}
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	snapshotRoot, err := getTrieRoot(chainStore, types.BlockNoToBytes(latestNo))
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !bytes.Equal(snapshotRoot, baseRoot) {
+		fmt.Println("The delta base root ", dm.Base, " doesn't match the snapshot state root ", base58.Encode(snapshotRoot))
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	fmt.Println("Snapshot block height: ", latestNo)
+	fmt.Println("Applying the delta of block height: ", dm.BlockHeight)
+	start := time.Now()
+	if dm.Format == archiveFormat {
+		stats, err := importDeltaArchive(store, baseRoot)
+		if err != nil {
+			store.Close()
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		displayImportStats(stats)
+	} else {
+		deltaStore := db.NewDB(db.BadgerImpl, path.Join(deltaPath, "state"))
+		stats, err := stool.CopyEntries(deltaStore, store)
+		deltaStore.Close()
+		if err != nil {
+			store.Close()
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		displayImportStats(stats)
+	}
+	fmt.Printf("Time to apply delta: %v\n", time.Since(start))
+
+	// verify the new state before replacing the chain
+	start = time.Now()
+	sa, missingNodes, err := verifyState(store, root, voteRoots, nil)
+	store.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Time to verify state: %v\n", time.Since(start))
+	displayResults(sa, false)
+	// exits and keeps the chain of the snapshot at the base root if nodes are missing
+	displayMissingNodes(missingNodes, "Delta verification")
+
+	// the chain of the delta contains the new blocks, the sql databases of the
+	// contracts changed by the delta replace the ones of the snapshot
+	fmt.Println("Copying the chain and sql state of the delta...")
+	err = replaceDir(path.Join(deltaPath, "chain"), chainPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	deltaSqlPath := path.Join(deltaPath, "statesql")
+	sqlFiles, err := ioutil.ReadDir(deltaSqlPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+		return
+	}
+	if len(sqlFiles) != 0 {
+		snapshotSqlPath := path.Join(snapshotPath, "statesql")
+		err = os.MkdirAll(snapshotSqlPath, 0755)
+		if err != nil {
+			fmt.Println("Enable to create snapshot statesql folder")
+			return
+		}
+		for _, f := range sqlFiles {
+			err = copyDir(path.Join(deltaSqlPath, f.Name()), snapshotSqlPath)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// the snapshot is now a complete snapshot of the delta block
+	dm.Base = ""
+	dm.Format = badgerFormat
+	dm.Counters = sa.Counters
+	dm.Stats = nil
+	err = writeManifest(snapshotPath, dm)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
+
+// importDeltaArchive imports the delta archive of the delta folder in store
+// after checking that it applies to baseRoot
+func importDeltaArchive(store db.DB, baseRoot []byte) (stool.SnapshotStats, error) {
+	file, err := os.Open(path.Join(deltaPath, archiveFile))
+	if err != nil {
+		return stool.SnapshotStats{}, err
+	}
+	defer file.Close()
+	header, err := stool.ReadArchiveHeader(file)
+	if err != nil {
+		return stool.SnapshotStats{}, err
+	}
+	if !bytes.Equal(header.Base, baseRoot) {
+		return stool.SnapshotStats{}, fmt.Errorf("the delta archive doesn't apply to the base root %s", base58.Encode(baseRoot))
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return stool.SnapshotStats{}, err
+	}
+	_, stats, err := stool.ImportArchiveWithRollback(file, store)
+	return stats, err
+}
+
+// replaceDir copies sourcePath to a temporary folder next to destinationPath and
+// only replaces destinationPath once the copy succeeded
+func replaceDir(sourcePath, destinationPath string) error {
+	tmpPath := destinationPath + ".tmp"
+	oldPath := destinationPath + ".old"
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = copyDir(sourcePath, tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	err = os.Rename(destinationPath, oldPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, destinationPath)
+	if err != nil {
+		// restore the previous folder
+		os.Rename(oldPath, destinationPath)
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
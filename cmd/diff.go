@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	from        string
+	to          string
+	diffStorage bool
+)
+
+func init() {
+	diffCmd.Flags().StringVar(&from, "from", "", "Block height or state root (b58) of the old state")
+	diffCmd.Flags().StringVar(&to, "to", "", "Block height or state root (b58) of the new state")
+	diffCmd.Flags().BoolVar(&diffStorage, "storage", false, "Also list the storage keys of contracts with a changed storage root")
+	diffCmd.MarkFlagRequired("from")
+	diffCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(diffCmd)
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "List the accounts that changed between two states",
+	Run:   execDiff,
+}
+
+func execDiff(cmd *cobra.Command, args []string) {
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+	// check db path and open db
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	fromRoot, err := getRootOrHeight(chainStore, from)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	toRoot, err := getRootOrHeight(chainStore, to)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	fmt.Println("\nComparing state root: ", base58.Encode(fromRoot))
+	fmt.Println("with state root:      ", base58.Encode(toRoot))
+	start := time.Now()
+	diffs, err := stool.Diff(store, fromRoot, toRoot)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Time to diff: %v\n", time.Since(start))
+	err = displayDiffs(store, diffs)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func displayDiffs(store db.DB, diffs []*stool.AccountDiff) error {
+	var nbAdded, nbRemoved, nbChanged int
+	for _, d := range diffs {
+		fmt.Println()
+		id := base58.Encode(d.Key)
+		if d.Old == nil {
+			nbAdded++
+			fmt.Println("+ Added account: ", id)
+			displayStateChange(&types.State{}, d.New)
+		} else if d.New == nil {
+			nbRemoved++
+			fmt.Println("- Removed account: ", id)
+			displayStateChange(d.Old, &types.State{})
+		} else {
+			nbChanged++
+			fmt.Println("~ Changed account: ", id)
+			displayStateChange(d.Old, d.New)
+		}
+		if diffStorage && !bytes.Equal(d.Old.GetStorageRoot(), d.New.GetStorageRoot()) {
+			storageDiffs, err := stool.DiffStorage(store, d.Old.GetStorageRoot(), d.New.GetStorageRoot())
+			if err != nil {
+				return err
+			}
+			displayStorageDiffs(storageDiffs)
+		}
+	}
+	fmt.Println("\nState diff results:")
+	fmt.Println("===================")
+	fmt.Println("* Number of added accounts: ", nbAdded)
+	fmt.Println("* Number of removed accounts: ", nbRemoved)
+	fmt.Println("* Number of changed accounts: ", nbChanged)
+	return nil
+}
+
+// displayStorageDiffs prints the storage keys of a contract with their value sizes
+func displayStorageDiffs(storageDiffs []*stool.StorageDiff) {
+	for _, sd := range storageDiffs {
+		key := hex.EncodeToString(sd.Key)
+		if sd.OldValue == nil {
+			fmt.Println("    + Inserted storage key: ", key, " (", len(sd.NewValue), " bytes)")
+		} else if sd.NewValue == nil {
+			fmt.Println("    - Deleted storage key: ", key, " (", len(sd.OldValue), " bytes)")
+		} else {
+			fmt.Println("    ~ Modified storage key: ", key, " (", len(sd.OldValue), " -> ", len(sd.NewValue), " bytes)")
+		}
+	}
+}
+
+// displayStateChange prints the old and new values of account fields that differ
+func displayStateChange(oldState, newState *types.State) {
+	oldBalance := new(big.Int).SetBytes(oldState.GetBalance())
+	newBalance := new(big.Int).SetBytes(newState.GetBalance())
+	if oldBalance.Cmp(newBalance) != 0 {
+		fmt.Println("    * Balance: ", oldBalance, " -> ", newBalance)
+	}
+	if oldState.GetNonce() != newState.GetNonce() {
+		fmt.Println("    * Nonce: ", oldState.GetNonce(), " -> ", newState.GetNonce())
+	}
+	if !bytes.Equal(oldState.GetCodeHash(), newState.GetCodeHash()) {
+		fmt.Println("    * Code hash: ", base58.Encode(oldState.GetCodeHash()), " -> ", base58.Encode(newState.GetCodeHash()))
+	}
+	if !bytes.Equal(oldState.GetStorageRoot(), newState.GetStorageRoot()) {
+		fmt.Println("    * Storage root: ", base58.Encode(oldState.GetStorageRoot()), " -> ", base58.Encode(newState.GetStorageRoot()))
+	}
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	archivePath string
+	mirrorURL   string
+	downloads   uint
+)
+
+func init() {
+	importCmd.Flags().StringVar(&archivePath, "archive", "", "Path/to/state.archive created by snapshot --format archive")
+	importCmd.Flags().StringVar(&mirrorURL, "mirror", "", "Url of the chunks folder of a snapshot created by snapshot --format chunks")
+	importCmd.Flags().UintVar(&downloads, "downloads", 4, "Number of chunks downloaded in parallel from the mirror")
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Rebuild the state database of a data folder from a snapshot archive or chunks mirror",
+	Run:   execImport,
+}
+
+func execImport(cmd *cobra.Command, args []string) {
+	if len(dbPath) == 0 {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	if (len(archivePath) == 0) == (len(mirrorURL) == 0) {
+		fmt.Println("Provide either an archive file or a mirror url")
+		return
+	}
+	statePath := path.Join(dbPath, "state")
+	if _, err := os.Stat(statePath); err == nil && !isEmpty(statePath) {
+		fmt.Println("State folder must be empty")
+		return
+	}
+	if len(mirrorURL) != 0 {
+		importChunks(statePath)
+		return
+	}
+	file, err := os.Open(archivePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+	header, err := stool.ReadArchiveHeader(file)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if header.Base != nil {
+		fmt.Println("The archive is a delta of state root ", base58.Encode(header.Base), ", use the apply-delta command")
+		return
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// the state is imported in a temporary folder moved to the state folder once verified
+	importPath, err := newImportFolder(statePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	store := db.NewDB(db.BadgerImpl, importPath)
+
+	fmt.Println("Importing the state archive...")
+	start := time.Now()
+	header, stats, err := stool.ImportArchive(file, store)
+	if err != nil {
+		fmt.Println(err)
+		discardImport(store, importPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Time to import archive: %v\n", time.Since(start))
+	displayImportStats(stats)
+
+	// verify the imported state against the roots of the archive
+	start = time.Now()
+	fmt.Println("Archive state root: ", base58.Encode(header.Root))
+	sa, missingNodes, err := verifyState(store, header.Root, header.VoteRoots, header.KeyRange)
+	if err != nil {
+		fmt.Println(err)
+		discardImport(store, importPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Time to verify state: %v\n", time.Since(start))
+	displayResults(sa, false)
+	if len(missingNodes) != 0 {
+		discardImport(store, importPath)
+	} else {
+		store.Close()
+		err = moveImport(importPath, statePath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	displayMissingNodes(missingNodes, "Import verification")
+}
+
+// importChunks downloads the chunks of a snapshot mirror in the state folder.
+// The mirror is not trusted: the chunks are verified against the state and vote
+// roots of the latest block of the chain db of the data folder.
+func importChunks(statePath string) {
+	chainPath := path.Join(dbPath, "chain")
+	if stat, err := os.Stat(chainPath); err != nil || !stat.IsDir() {
+		fmt.Println("The chain database of the data folder is required to verify the chunks, copy the chain folder of the snapshot first")
+		return
+	}
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	root, err := getTrieRoot(chainStore, types.BlockNoToBytes(latestNo))
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	voteRootBytes1, voteRootBytes2, err := getVoteTrieRoots(chainStore, latestNo)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// only the number of chunks is read from the mirror index
+	index, err := stool.FetchChunkIndex(http.DefaultClient, mirrorURL)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	specs, err := stool.StateChunks(root, index.ChunkBits)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	votingContract := votingContractKey()
+	specs = append(specs,
+		stool.AccountChunk(voteChunkName(1), voteRootBytes1, votingContract),
+		stool.AccountChunk(voteChunkName(2), voteRootBytes2, votingContract))
+
+	importPath, err := newImportFolder(statePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	store := db.NewDB(db.BadgerImpl, importPath)
+	fmt.Println("Block height: ", latestNo)
+	fmt.Println("Downloading and verifying ", len(specs), " chunks of state root: ", base58.Encode(root))
+	start := time.Now()
+	stats, err := stool.FetchChunks(http.DefaultClient, mirrorURL, specs, store, dbPath, downloads)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Import verification: failed")
+		discardImport(store, importPath)
+		os.Exit(1)
+	}
+	store.Close()
+	err = moveImport(importPath, statePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Time to import chunks: %v\n", time.Since(start))
+	displayImportStats(stats)
+	fmt.Println("Import verification: pass")
+}
+
+// newImportFolder creates an empty temporary folder next to the state folder,
+// the leftovers of an interrupted import are removed
+func newImportFolder(statePath string) (string, error) {
+	importPath := statePath + ".import"
+	err := os.RemoveAll(importPath)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(importPath, 0755)
+	if err != nil {
+		return "", fmt.Errorf("Enable to create import folder")
+	}
+	return importPath, nil
+}
+
+// discardImport closes and removes the state imported in the temporary folder
+func discardImport(store db.DB, importPath string) {
+	store.Close()
+	os.RemoveAll(importPath)
+}
+
+// moveImport replaces the empty state folder by the verified imported state
+func moveImport(importPath, statePath string) error {
+	err := os.RemoveAll(statePath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(importPath, statePath)
+}
+
+func displayImportStats(stats stool.SnapshotStats) {
+	fmt.Println("* Number of trie node batches: ", stats.NbTrieNodes)
+	fmt.Println("* Number of values: ", stats.NbValues)
+	fmt.Println("* Number of contract codes: ", stats.NbCodes)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyChecksum bool
+)
+
+func init() {
+	infoCmd.Flags().BoolVar(&verifyChecksum, "checksum", false, "Verify the checksum of the snapshot files")
+	rootCmd.AddCommand(infoCmd)
+}
+
+var infoCmd = &cobra.Command{
+	Use:   "info <path>",
+	Short: "Print the manifest of a snapshot or the latest block of a data folder",
+	Args:  cobra.ExactArgs(1),
+	Run:   execInfo,
+}
+
+func execInfo(cmd *cobra.Command, args []string) {
+	dataPath := args[0]
+	if stat, err := os.Stat(dataPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	m, err := readManifest(dataPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if m == nil {
+		// not a snapshot: describe the latest block of the chain db
+		chainPath := path.Join(dataPath, "chain")
+		if stat, err := os.Stat(chainPath); err != nil || !stat.IsDir() {
+			fmt.Println("No snapshot manifest or chain database found: ", dataPath, " is not a data folder")
+			return
+		}
+		fmt.Println("No snapshot manifest found, reading the chain database...")
+		chainStore := db.NewDB(db.BadgerImpl, chainPath)
+		latestNo, err := getLatestBlockNo(chainStore)
+		if err == nil {
+			m, err = newManifest(chainStore, latestNo)
+		}
+		chainStore.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		m.Version = ""
+		m.Sizes = getFolderSizes(dataPath)
+		displayManifest(m)
+		return
+	}
+	displayManifest(m)
+	if verifyChecksum {
+		checksum, err := snapshotChecksum(dataPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if checksum != m.Checksum {
+			fmt.Println("Checksum verification: failed, got ", checksum)
+			os.Exit(1)
+		}
+		fmt.Println("Checksum verification: pass")
+	}
+}
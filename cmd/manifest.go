@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	sha256 "github.com/minio/sha256-simd"
+	"github.com/mr-tron/base58/base58"
+	"github.com/sunpuyo/badger"
+)
+
+// manifestFile is the name of the manifest written in the snapshot folder
+const manifestFile = "manifest.json"
+
+// manifest describes the content of a snapshot
+type manifest struct {
+	Version     string          `json:"version"`
+	Format      string          `json:"format,omitempty"`
+	ChainID     string          `json:"chainId"`
+	BlockHeight uint64          `json:"blockHeight"`
+	BlockHash   string          `json:"blockHash"`
+	StateRoot   string          `json:"stateRoot"`
+	VoteRoots   []string        `json:"voteRoots"`
+	KeyRange    *stool.KeyRange `json:"keyRange,omitempty"`
+	// Base is the state root of the snapshot a delta snapshot applies to
+	Base     string               `json:"base,omitempty"`
+	Counters *stool.Counters      `json:"counters,omitempty"`
+	Stats    *stool.SnapshotStats `json:"stats,omitempty"`
+	Sizes    *folderSizes         `json:"sizes"`
+	// Checksum is the sha256 of the state and chain databases content, of the statesql files and of the state archive or chunks
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// newManifest creates a manifest of the block at blockNo
+func newManifest(chainStore db.DB, blockNo uint64) (*manifest, error) {
+	block, err := getBlock(chainStore, types.BlockNoToBytes(blockNo))
+	if err != nil {
+		return nil, err
+	}
+	voteRoot1, voteRoot2, err := getVoteTrieRoots(chainStore, blockNo)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{
+		Version:     version,
+		ChainID:     chainIDString(block.Header.ChainID),
+		BlockHeight: blockNo,
+		BlockHash:   base58.Encode(block.Hash),
+		StateRoot:   base58.Encode(block.Header.BlocksRootHash),
+		VoteRoots:   []string{base58.Encode(voteRoot1), base58.Encode(voteRoot2)},
+	}, nil
+}
+
+// chainIDString returns the magic of a serialized chain id
+func chainIDString(raw []byte) string {
+	cid := types.NewChainID()
+	if err := cid.Read(raw); err != nil {
+		return base58.Encode(raw)
+	}
+	return cid.Magic
+}
+
+// writeManifest computes the sizes and checksum of a snapshot and writes its manifest
+func writeManifest(snapshotPath string, m *manifest) error {
+	m.Sizes = getFolderSizes(snapshotPath)
+	checksum, err := snapshotChecksum(snapshotPath)
+	if err != nil {
+		return err
+	}
+	m.Checksum = checksum
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(snapshotPath, manifestFile), raw, 0644)
+}
+
+// readManifest reads the manifest of a snapshot, returns nil if there is none
+func readManifest(snapshotPath string) (*manifest, error) {
+	raw, err := ioutil.ReadFile(path.Join(snapshotPath, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	err = json.Unmarshal(raw, m)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest file: %v", err)
+	}
+	return m, nil
+}
+
+// snapshotChecksum hashes the content of a snapshot in a fixed order: the
+// key/value pairs of the state and chain databases in key order, and the paths
+// and content of the statesql files and of the state archive or chunks in lexical order.
+// Opening the badger databases rewrites their files so they are hashed by content,
+// the lmdb lock files of the sql databases are skipped for the same reason.
+func snapshotChecksum(snapshotPath string) (string, error) {
+	hasher := sha256.New()
+	for _, folder := range []string{"state", archiveFile, chunksFolder, "chain", "statesql"} {
+		if folder == "state" || folder == "chain" {
+			err := hashDb(hasher, path.Join(snapshotPath, folder))
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		err := filepath.Walk(path.Join(snapshotPath, folder), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || strings.HasSuffix(p, ".db-lock") {
+				return nil
+			}
+			rel, err := filepath.Rel(snapshotPath, p)
+			if err != nil {
+				return err
+			}
+			hasher.Write([]byte(rel))
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(hasher, f)
+			return err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashDb writes the length prefixed keys and values of the badger database
+// at dbPath to hasher in key order, nothing if the database doesn't exist
+func hashDb(hasher io.Writer, dbPath string) error {
+	if stat, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return fmt.Errorf("%s is not a database folder", dbPath)
+	}
+	hasher.Write([]byte(filepath.Base(dbPath)))
+	// the db is opened read only with badger directly: aergo-lib opens it in
+	// read-write mode and doesn't discard the transaction of its iterators
+	opts := badgerOptions(dbPath)
+	opts.ReadOnly = true
+	bdb, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+	return bdb.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		var size [4]byte
+		write := func(data []byte) error {
+			binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+			hasher.Write(size[:])
+			hasher.Write(data)
+			return nil
+		}
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			write(item.Key())
+			err := item.Value(write)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addSnapshotStats sums the stats of the state and vote roots snapshots
+func addSnapshotStats(stats ...stool.SnapshotStats) *stool.SnapshotStats {
+	total := &stool.SnapshotStats{}
+	for _, s := range stats {
+		total.NbTrieNodes += s.NbTrieNodes
+		total.NbValues += s.NbValues
+		total.NbCodes += s.NbCodes
+		total.TrieNodesSize += s.TrieNodesSize
+		total.ValuesSize += s.ValuesSize
+		total.CodesSize += s.CodesSize
+	}
+	return total
+}
+
+func displayManifest(m *manifest) {
+	fmt.Println("\nSnapshot information:")
+	fmt.Println("=====================")
+	if len(m.Version) != 0 {
+		fmt.Println("* state-tools version: ", m.Version)
+	}
+	if len(m.Format) != 0 {
+		fmt.Println("* Snapshot format: ", m.Format)
+	}
+	fmt.Println("* Chain ID: ", m.ChainID)
+	fmt.Println("* Block height: ", m.BlockHeight)
+	fmt.Println("* Block hash: ", m.BlockHash)
+	fmt.Println("* State root: ", m.StateRoot)
+	for _, voteRoot := range m.VoteRoots {
+		fmt.Println("* Vote root: ", voteRoot)
+	}
+	if len(m.Base) != 0 {
+		fmt.Println("* Delta of base state root: ", m.Base)
+	}
+	if m.KeyRange != nil {
+		fmt.Println("* Key range start: ", hex.EncodeToString(m.KeyRange.Start))
+		fmt.Println("* Key range end: ", hex.EncodeToString(m.KeyRange.End))
+	}
+	if c := m.Counters; c != nil {
+		fmt.Println("* Number of contracts: ", c.NbContracts)
+		fmt.Println("* Number of pubKey accounts + 1 (staking contract): ", c.NbUserAccounts)
+		fmt.Println("* Number of 0 balance pubkeys: ", c.NbUserAccounts0)
+		fmt.Println("* Number of nil (0 nonce, 0 balance) objects: ", c.NbNilObjects)
+		fmt.Println("* Total Aer Balance of all pubKeys and contracts: ", c.TotalAerBalance)
+		fmt.Printf("* Average trie depth: %.2f\n", c.AverageDepth)
+		fmt.Println("* Deepest leaf in the trie: ", c.DeepestLeaf)
+	}
+	if s := m.Stats; s != nil {
+		fmt.Println("* Number of trie node batches: ", s.NbTrieNodes, " (", float64(s.TrieNodesSize)/1024.0/1024.0, " Mb)")
+		fmt.Println("* Number of values: ", s.NbValues, " (", float64(s.ValuesSize)/1024.0/1024.0, " Mb)")
+		fmt.Println("* Number of contract codes: ", s.NbCodes, " (", float64(s.CodesSize)/1024.0/1024.0, " Mb)")
+	}
+	if m.Sizes != nil {
+		fmt.Println("* Total blockchain size: ", float64(m.Sizes.Total)/1024.0/1024.0, " Mb")
+		fmt.Println("* State size: ", float64(m.Sizes.State)/1024.0/1024.0, " Mb")
+		fmt.Println("* Chain size: ", float64(m.Sizes.Chain)/1024.0/1024.0, " Mb")
+		fmt.Println("* SQL State size: ", float64(m.Sizes.StateSql)/1024.0/1024.0, " Mb")
+	}
+	if len(m.Checksum) != 0 {
+		fmt.Println("* Checksum: ", m.Checksum)
+	}
+}
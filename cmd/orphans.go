@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/spf13/cobra"
+)
+
+var orphanBlocks uint64
+
+func init() {
+	orphansCmd.Flags().Uint64Var(&orphanBlocks, "keepBlocks", 1, "Number of last blocks whose state is reachable")
+	rootCmd.AddCommand(orphansCmd)
+}
+
+var orphansCmd = &cobra.Command{
+	Use:   "orphans",
+	Short: "Report the state db keys per class that are not reachable from the last blocks and vote roots",
+	Run:   execOrphans,
+}
+
+func execOrphans(cmd *cobra.Command, args []string) {
+	// check db path
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	if orphanBlocks == 0 {
+		fmt.Println("The state of at least 1 block must be reachable")
+		return
+	}
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+
+	// query the state roots of the last blocks and their vote roots
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	roots, voteRoots, err := keptRoots(chainStore, latestNo, orphanBlocks)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	fmt.Println("Latest block height: ", latestNo)
+	start := time.Now()
+	r, err := markRoots(store, roots, voteRoots)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Time to mark reachable entries: %v\n", time.Since(start))
+	fmt.Println("Classifying the keys of the state database...")
+	start = time.Now()
+	report := stool.Orphans(store, r)
+	fmt.Printf("Time to classify keys: %v\n", time.Since(start))
+	displayOrphans(report)
+}
+
+func displayOrphans(report *stool.OrphansReport) {
+	fmt.Println("\nOrphaned keys results:")
+	fmt.Println("======================")
+	var total, totalOrphans stool.ClassStats
+	for _, class := range stool.KeyClasses {
+		reachable, orphans := report.Reachable[class], report.Unreachable[class]
+		fmt.Printf("* %s: %d reachable (%.2f Mb), %d unreachable (%.2f Mb)\n", class,
+			reachable.Nb, float64(reachable.Size)/1024.0/1024.0, orphans.Nb, float64(orphans.Size)/1024.0/1024.0)
+		total.Nb += reachable.Nb + orphans.Nb
+		total.Size += reachable.Size + orphans.Size
+		totalOrphans.Nb += orphans.Nb
+		totalOrphans.Size += orphans.Size
+	}
+	fmt.Println("* Total number of keys: ", total.Nb, " (", float64(total.Size)/1024.0/1024.0, " Mb)")
+	fmt.Println("* Total number of unreachable keys: ", totalOrphans.Nb, " (", float64(totalOrphans.Size)/1024.0/1024.0, " Mb)")
+	for _, key := range report.UnknownKeys {
+		fmt.Println("* Unknown key: ", hex.EncodeToString(key))
+	}
+}
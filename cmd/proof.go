@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	compressed bool
+	outputPath string
+)
+
+func init() {
+	proofCmd.Flags().StringVarP(&address, "address", "a", "", "Address (b58) or name of the account to prove")
+	proofCmd.Flags().StringVarP(&root, "root", "r", "", "State root (b58) of the proof")
+	proofCmd.Flags().Uint64VarP(&blockHeight, "blockHeight", "b", 0, "Block height of the proven state (default latest)")
+	proofCmd.Flags().StringVarP(&storageKey, "key", "k", "", "Raw storage key (string or 0x prefixed hex) to prove in the contract storage")
+	proofCmd.Flags().StringVar(&varName, "var", "", "Name of the lua state variable to prove in the contract storage")
+	proofCmd.Flags().StringVar(&varKey, "varKey", "", "Key of the state.map or index of the state.array variable")
+	proofCmd.Flags().BoolVar(&compressed, "compressed", false, "Generate a compressed proof (bitmap of non default nodes)")
+	proofCmd.Flags().StringVarP(&outputPath, "output", "o", "", "Write the json proof to a file instead of stdout")
+	proofCmd.MarkFlagRequired("address")
+	rootCmd.AddCommand(proofCmd)
+}
+
+var proofCmd = &cobra.Command{
+	Use:   "proof",
+	Short: "Generate a merkle proof of inclusion or non-inclusion of an account or storage key",
+	Run:   execProof,
+}
+
+func execProof(cmd *cobra.Command, args []string) {
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+	// check db path and open db
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	if len(root) != 0 && blockHeight != 0 {
+		fmt.Println("choose between root and blockHeight flags")
+		return
+	}
+	if len(storageKey) != 0 && len(varName) != 0 {
+		fmt.Println("choose between key and var flags")
+		return
+	}
+	addr, err := types.DecodeAddress(address)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	trieKey := types.ToAccountID(addr)
+
+	var rootBytes []byte
+	if len(root) != 0 {
+		rootBytes, err = base58.Decode(root)
+	} else {
+		chainStore := db.NewDB(db.BadgerImpl, chainPath)
+		rootBytes, err = getHeightTrieRoot(chainStore, blockHeight)
+		chainStore.Close()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	tr := stool.NewTrieReader(store, false)
+	provenRoot, provenKey := rootBytes, trieKey[:]
+	if len(storageKey) != 0 || len(varName) != 0 {
+		// prove the storage key in the contract storage trie
+		state, err := tr.Get(rootBytes, trieKey[:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if state == nil || len(state.GetStorageRoot()) == 0 {
+			fmt.Println("Contract storage not found in the state trie")
+			return
+		}
+		key, err := getStorageKey()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		provenRoot, provenKey = state.GetStorageRoot(), stool.Hasher(key)
+	}
+
+	var proof *stool.Proof
+	if compressed {
+		proof, err = tr.ProveCompressed(provenRoot, provenKey)
+	} else {
+		proof, err = tr.Prove(provenRoot, provenKey)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	raw, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(outputPath) != 0 {
+		err = ioutil.WriteFile(outputPath, raw, 0644)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	fmt.Println(string(raw))
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+	"github.com/sunpuyo/badger"
+	"github.com/sunpuyo/badger/options"
+)
+
+var (
+	pruneBlocks uint64
+	dryRun      bool
+)
+
+// badgerGCDiscardRatio is the ratio of a value log file that must be
+// reclaimable for the file to be rewritten
+const badgerGCDiscardRatio = 0.5
+
+func init() {
+	pruneCmd.Flags().Uint64Var(&pruneBlocks, "keepBlocks", 100, "Number of last blocks whose state is kept")
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only report the number and size of the entries that would be deleted")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete the state entries that are not reachable from the last blocks and vote roots",
+	Run:   execPrune,
+}
+
+func execPrune(cmd *cobra.Command, args []string) {
+	// check db path
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	if pruneBlocks == 0 {
+		fmt.Println("The state of at least 1 block must be kept")
+		return
+	}
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+
+	// query the state roots of the last blocks and their vote roots
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	roots, voteRoots, err := keptRoots(chainStore, latestNo, pruneBlocks)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	displayFolderSizes(dbPath, "Size information BEFORE prune:")
+
+	// mark the reachable entries, a missing node stops the prune
+	store := db.NewDB(db.BadgerImpl, statePath)
+	fmt.Println("\nLatest block height: ", latestNo)
+	start := time.Now()
+	r, err := markRoots(store, roots, voteRoots)
+	if err != nil {
+		store.Close()
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Time to mark reachable entries: %v\n", time.Since(start))
+	fmt.Println("* Number of reachable entries: ", r.Len())
+
+	if dryRun {
+		fmt.Println("Counting the unreachable entries...")
+	} else {
+		fmt.Println("Deleting the unreachable entries...")
+	}
+	start = time.Now()
+	stats := stool.Prune(store, r, dryRun)
+	store.Close()
+	fmt.Printf("Time to prune: %v\n", time.Since(start))
+	displayPruneStats(stats)
+	if dryRun {
+		return
+	}
+
+	fmt.Println("Running value log garbage collection...")
+	err = runValueLogGC(statePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	displayFolderSizes(dbPath, "Size information AFTER prune:")
+}
+
+// keptRoots returns the state roots of the last nbBlocks blocks up to latestNo
+// and the vote roots of these blocks without duplicates
+func keptRoots(chainStore db.DB, latestNo, nbBlocks uint64) ([][]byte, [][]byte, error) {
+	var roots, voteRoots [][]byte
+	seenRoots := make(map[string]bool)
+	seenVoteRoots := make(map[string]bool)
+	for blockNo := latestNo; blockNo+nbBlocks > latestNo; blockNo-- {
+		root, err := getTrieRoot(chainStore, types.BlockNoToBytes(blockNo))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !seenRoots[string(root)] {
+			seenRoots[string(root)] = true
+			roots = append(roots, root)
+		}
+		voteRoot1, voteRoot2, err := getVoteTrieRoots(chainStore, blockNo)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, voteRoot := range [][]byte{voteRoot1, voteRoot2} {
+			if !seenVoteRoots[string(voteRoot)] {
+				seenVoteRoots[string(voteRoot)] = true
+				voteRoots = append(voteRoots, voteRoot)
+			}
+		}
+		if blockNo == 0 {
+			break
+		}
+	}
+	return roots, voteRoots, nil
+}
+
+// markRoots marks the state of roots and the voting contract of voteRoots
+func markRoots(store db.DB, roots, voteRoots [][]byte) (*stool.Reachable, error) {
+	fmt.Println("Marking the state of ", len(roots), " roots and the voting contract of ", len(voteRoots), " vote roots...")
+	r := stool.NewReachable()
+	for _, root := range roots {
+		err := stool.NewStateAnalysis(store, false, true, false, workers).Mark(r, root)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to mark state root %s: %v", base58.Encode(root), err)
+		}
+	}
+	votingContract := votingContractKey()
+	for _, voteRoot := range voteRoots {
+		err := stool.NewStateAnalysis(store, false, true, false, workers).MarkAccount(r, voteRoot, votingContract)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to mark vote root %s: %v", base58.Encode(voteRoot), err)
+		}
+	}
+	return r, nil
+}
+
+// badgerOptions returns the options aergo-lib opens a badger db of dir with
+func badgerOptions(dir string) badger.Options {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	opts.ValueLogLoadingMode = options.FileIO
+	opts.TableLoadingMode = options.FileIO
+	opts.ValueThreshold = 1024
+	opts.ValueLogFileSize = 1<<26 - 1
+	return opts
+}
+
+// runValueLogGC rewrites the value log files of a badger db until no file has
+// enough deleted entries. aergo-lib doesn't expose the garbage collection so
+// the db is opened directly with the options of aergo-lib.
+func runValueLogGC(dir string) error {
+	bdb, err := badger.Open(badgerOptions(dir))
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+	nbRewrites := 0
+	for {
+		err = bdb.RunValueLogGC(badgerGCDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			break
+		} else if err != nil {
+			return err
+		}
+		nbRewrites++
+	}
+	fmt.Println("* Number of value log files rewritten: ", nbRewrites)
+	return nil
+}
+
+func displayPruneStats(stats stool.PruneStats) {
+	title := "Prune results:"
+	if dryRun {
+		title = "Prune dry run results:"
+	}
+	fmt.Println("\n" + title)
+	fmt.Println(strings.Repeat("=", len(title)))
+	fmt.Println("* Number of entries kept: ", stats.NbKept, " (", float64(stats.KeptSize)/1024.0/1024.0, " Mb)")
+	fmt.Println("* Number of other keys kept: ", stats.NbOther)
+	if dryRun {
+		fmt.Println("* Number of entries that would be deleted: ", stats.NbDeleted)
+		fmt.Println("* Bytes that would be reclaimed: ", stats.DeletedSize, " (", float64(stats.DeletedSize)/1024.0/1024.0, " Mb)")
+		return
+	}
+	fmt.Println("* Number of entries deleted: ", stats.NbDeleted)
+	fmt.Println("* Bytes deleted: ", stats.DeletedSize, " (", float64(stats.DeletedSize)/1024.0/1024.0, " Mb)")
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	repairSourcePath string
+	repairBlocks     uint64
+)
+
+func init() {
+	repairCmd.Flags().StringVar(&repairSourcePath, "source", "", "Path/to/other/blockchain/database/folder/data (other node or older snapshot)")
+	repairCmd.Flags().Uint64Var(&repairBlocks, "blocks", 1, "Number of last blocks whose state is repaired")
+	repairCmd.MarkFlagRequired("source")
+	rootCmd.AddCommand(repairCmd)
+}
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Replace the missing or corrupted state entries by their copy in another database",
+	Run:   execRepair,
+}
+
+func execRepair(cmd *cobra.Command, args []string) {
+	// check db paths
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	sourceStatePath := path.Join(repairSourcePath, "state")
+	if stat, err := os.Stat(sourceStatePath); err != nil || !stat.IsDir() {
+		fmt.Println("The source doesn't contain a state database")
+		return
+	}
+	if repairBlocks == 0 {
+		fmt.Println("The state of at least 1 block must be repaired")
+		return
+	}
+
+	// query the state roots of the last blocks and their vote roots
+	chainStore := db.NewDB(db.BadgerImpl, path.Join(dbPath, "chain"))
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	roots, voteRoots, err := keptRoots(chainStore, latestNo, repairBlocks)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, path.Join(dbPath, "state"))
+	defer store.Close()
+	source := db.NewDB(db.BadgerImpl, sourceStatePath)
+	defer source.Close()
+	fmt.Println("Latest block height: ", latestNo)
+	start := time.Now()
+	var stats stool.RepairStats
+	var failures []*stool.MissingNode
+	repair := func(root []byte, trieKey []byte) error {
+		sa := stool.NewStateAnalysis(store, false, true, false, workers)
+		sa.SetRepairSource(source)
+		sa.CollectIntegrityFailures()
+		var err error
+		if trieKey == nil {
+			err = sa.Analyse(root)
+		} else {
+			err = sa.AnalyseAccount(root, trieKey)
+		}
+		if err != nil {
+			return err
+		}
+		s := sa.RepairStats()
+		stats.NbTrieNodes += s.NbTrieNodes
+		stats.NbValues += s.NbValues
+		stats.NbCodes += s.NbCodes
+		stats.NbUnrepaired += s.NbUnrepaired
+		failures = append(failures, sa.MissingNodes()...)
+		return nil
+	}
+	for _, root := range roots {
+		fmt.Println("Repairing state root: ", base58.Encode(root))
+		err = repair(root, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	votingContract := votingContractKey()
+	for _, voteRoot := range voteRoots {
+		fmt.Println("Repairing vote root: ", base58.Encode(voteRoot))
+		err = repair(voteRoot, votingContract)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fmt.Printf("Time to repair: %v\n", time.Since(start))
+	displayRepairResults(stats, failures)
+}
+
+// displayRepairResults prints the repaired entries and the remaining failures
+// and exits with an error code if the state is still corrupted
+func displayRepairResults(stats stool.RepairStats, failures []*stool.MissingNode) {
+	title := "Repair results:"
+	fmt.Println("\n" + title)
+	fmt.Println(strings.Repeat("=", len(title)))
+	fmt.Println("* Number of trie nodes repaired: ", stats.NbTrieNodes)
+	fmt.Println("* Number of values repaired: ", stats.NbValues)
+	fmt.Println("* Number of codes repaired: ", stats.NbCodes)
+	fmt.Println("* Number of entries missing or corrupted in the source: ", stats.NbUnrepaired)
+	for _, f := range failures {
+		fmt.Println("* Unrepaired ", f.Kind, ": ", base58.Encode(f.Hash), " at height ", f.Height)
+	}
+	if len(failures) != 0 {
+		fmt.Println("Repair: failed")
+		os.Exit(1)
+	}
+	fmt.Println("Repair: pass")
+}
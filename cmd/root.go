@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
 
 	"github.com/spf13/cobra"
 )
@@ -11,6 +13,7 @@ var (
 	dbPath         string
 	countDBReads   bool
 	integrityCheck bool
+	workers        uint
 )
 
 var rootCmd = &cobra.Command{
@@ -21,13 +24,32 @@ var rootCmd = &cobra.Command{
 	- Analyse without state integrity: gets information about trie leaves
 	- Analyse with state integrity: gets information about trie leaves and also analyses contract storage tries for integrity.
 	- Snapshot state (copies the general and contract tries)`,
+	PersistentPreRunE: checkDbPath,
+}
+
+// withoutDbPath are the commands that don't read the database of dbPath
+var withoutDbPath = map[string]bool{
+	"apply-delta":     true,
+	"help":            true,
+	"info":            true,
+	"verify-proof":    true,
+	"verify-snapshot": true,
+	"version":         true,
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&dbPath, "dbPath", "p", "", "Path/to/blockchain/database/folder/data")
 	rootCmd.PersistentFlags().BoolVarP(&countDBReads, "countDBReads", "c", true, "Make a counter of db reads")
 	rootCmd.PersistentFlags().BoolVarP(&integrityCheck, "integrityCheck", "i", true, "Analyse general and all contract trie nodes to check integrity.")
-	rootCmd.MarkPersistentFlagRequired("dbPath")
+	rootCmd.PersistentFlags().UintVarP(&workers, "workers", "w", uint(8*runtime.NumCPU()), "Number of goroutines traversing the trie")
+}
+
+// checkDbPath requires the dbPath flag for the commands reading a database
+func checkDbPath(cmd *cobra.Command, args []string) error {
+	if len(dbPath) == 0 && !withoutDbPath[cmd.Name()] {
+		return errors.New(`required flag(s) "dbPath" not set`)
+	}
+	return nil
 }
 
 func Execute() {
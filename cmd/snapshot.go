@@ -1,24 +1,54 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"time"
 
 	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
 	"github.com/aergoio/state-tools/stool"
-	sha256 "github.com/minio/sha256-simd"
+	"github.com/mr-tron/base58/base58"
 	"github.com/spf13/cobra"
 )
 
 var (
-	snapshotPath string
+	snapshotPath   string
+	snapshotMemory uint
+	keepBlocks     uint64
+	sqlShell       string
+	snapshotFormat string
+	chunkBits      int
+	base           string
+)
+
+const (
+	// badgerFormat snapshots the state in a badger db
+	badgerFormat = "badger"
+	// archiveFormat snapshots the state in a single archive file
+	archiveFormat = "archive"
+	// archiveFile is the name of the state archive in the snapshot folder
+	archiveFile = "state.archive"
+	// chunksFormat snapshots the state in key range chunks that can be verified on their own
+	chunksFormat = "chunks"
+	// chunksFolder is the name of the folder of the state chunks in the snapshot folder
+	chunksFolder = "chunks"
 )
 
 func init() {
 	snapshotCmd.Flags().StringVarP(&snapshotPath, "snapshotPath", "s", "", "Path/to/a/new/empty/folder/data")
 	snapshotCmd.MarkFlagRequired("snapshotPath")
+	snapshotCmd.Flags().UintVar(&snapshotMemory, "snapshotMemory", stool.DefaultSnapshotMemory>>20, "Memory in MB used to cache nodes before writing them to the snapshot")
+	snapshotCmd.Flags().Uint64VarP(&blockHeight, "blockHeight", "b", 0, "Block height of the snapshot (default latest)")
+	snapshotCmd.Flags().Uint64Var(&keepBlocks, "keepBlocks", 1, "Number of blocks to keep in the chain up to the snapshot height")
+	snapshotCmd.Flags().StringVar(&snapshotFormat, "format", badgerFormat, "Format of the state snapshot: badger, archive (single file) or chunks")
+	snapshotCmd.Flags().IntVar(&chunkBits, "chunkBits", 4, "Split the state in 2^chunkBits chunks with the chunks format")
+	snapshotCmd.Flags().StringVar(&sqlShell, "sqlite", "sqlite3", "Sqlite shell built with LiteTree branches (like aergo) used to roll the sql databases back to the snapshot recovery points")
+	snapshotCmd.Flags().StringVar(&base, "base", "", "Block height or state root (b58) of a previous snapshot: only write the state that changed since then (delta)")
+	addKeyRangeFlags(snapshotCmd)
 	rootCmd.AddCommand(snapshotCmd)
 }
 
@@ -43,58 +73,118 @@ func execSnapshot(cmd *cobra.Command, args []string) {
 		fmt.Println("Snapshot folder must be empty")
 		return
 	}
+	if snapshotFormat != badgerFormat && snapshotFormat != archiveFormat && snapshotFormat != chunksFormat {
+		fmt.Println("Invalid snapshot format: ", snapshotFormat)
+		return
+	}
+	keyRange, err := getKeyRange()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if keyRange != nil && snapshotFormat == chunksFormat {
+		fmt.Println("A key range cannot be used with the chunks format")
+		return
+	}
+	if len(base) != 0 && (keyRange != nil || snapshotFormat == chunksFormat) {
+		fmt.Println("A delta snapshot cannot be used with a key range or the chunks format")
+		return
+	}
 	statePath := path.Join(dbPath, "state")
 	chainPath := path.Join(dbPath, "chain")
 	sqlPath := path.Join(dbPath, "statesql")
-	snapshotStatePath := path.Join(snapshotPath, "state")
 	snapshotChainPath := path.Join(snapshotPath, "chain")
 	snapshotSqlPath := path.Join(snapshotPath, "statesql")
 
 	chainStore := db.NewDB(db.BadgerImpl, chainPath)
-	// query latest state root in chain db
-	lastRootBytes, err := getLatestTrieRoot(chainStore)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	snapshotNo := latestNo
+	if blockHeight != 0 {
+		if blockHeight > latestNo {
+			chainStore.Close()
+			fmt.Println("Block height is higher than the latest block: ", latestNo)
+			return
+		}
+		snapshotNo = blockHeight
+	}
+	// query state root of the snapshot block in chain db
+	lastRootBytes, err := getTrieRoot(chainStore, types.BlockNoToBytes(snapshotNo))
 	if err != nil {
+		chainStore.Close()
 		fmt.Println(err)
 		return
 	}
-	// query last vote root trie root
+	// query vote trie roots of the snapshot block
 	// it is necessary to snapshot that trie because the dpos will query votes there
-	voteRootBytes1, voteRootBytes2, err := getVoteTrieRoots(chainStore)
+	voteRootBytes1, voteRootBytes2, err := getVoteTrieRoots(chainStore, snapshotNo)
 	if err != nil {
+		chainStore.Close()
 		fmt.Println(err)
 		return
 	}
 
-	err = os.MkdirAll(snapshotStatePath, 0755)
+	m, err := newManifest(chainStore, snapshotNo)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	m.Format = snapshotFormat
+	m.KeyRange = keyRange
+	var baseRootBytes []byte
+	if len(base) != 0 {
+		baseRootBytes, err = getRootOrHeight(chainStore, base)
+		if err != nil {
+			chainStore.Close()
+			fmt.Println(err)
+			return
+		}
+		m.Base = base58.Encode(baseRootBytes)
+	}
+	target, err := newSnapshotTarget(snapshotFormat, snapshotPath, m)
 	if err != nil {
-		fmt.Println("Enable to create snapshot state folder")
+		chainStore.Close()
+		fmt.Println(err)
 		return
 	}
+	target.base = baseRootBytes
 
 	store := db.NewDB(db.BadgerImpl, statePath)
-	snapshotStore := db.NewDB(db.BadgerImpl, snapshotStatePath)
 
-	// snapshot last state
+	// snapshot state at snapshotNo
+	fmt.Println("Snapshot block height: ", snapshotNo)
+	if baseRootBytes != nil {
+		fmt.Println("Delta from base state root: ", m.Base)
+	}
 	fmt.Println("Iterating the Aergo state trie to create snapshot...")
 	start := time.Now()
-	sa := stool.NewStateAnalysis(store, countDBReads, true, integrityCheck, 10000)
-	err = sa.Snapshot(snapshotStore, lastRootBytes)
+	sa := stool.NewStateAnalysis(store, countDBReads, true, integrityCheck, workers)
+	sa.SetKeyRange(keyRange)
+	sv := newSqlVisitor()
+	sa.AddVisitors(sv)
+	sa.SetSnapshotMemory(int(snapshotMemory) << 20)
+	err = target.snapshot(sa, lastRootBytes)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	// snapshot last vote states
-	hasher := sha256.New()
-	hasher.Write([]byte("aergo.system"))
-	votingContract := hasher.Sum(nil)
-	sva := stool.NewStateAnalysis(store, false, true, integrityCheck, 10000)
-	err = sva.SnapshotAccount(snapshotStore, voteRootBytes1, votingContract)
+	votingContract := votingContractKey()
+	sva := stool.NewStateAnalysis(store, false, true, integrityCheck, workers)
+	sva.SetSnapshotMemory(int(snapshotMemory) << 20)
+	err = target.snapshotAccount(sva, voteRootBytes1, votingContract)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	sva = stool.NewStateAnalysis(store, false, true, integrityCheck, 10000)
-	err = sva.SnapshotAccount(snapshotStore, voteRootBytes2, votingContract)
+	sva = stool.NewStateAnalysis(store, false, true, integrityCheck, workers)
+	sva.SetSnapshotMemory(int(snapshotMemory) << 20)
+	err = target.snapshotAccount(sva, voteRootBytes2, votingContract)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -104,73 +194,230 @@ func execSnapshot(cmd *cobra.Command, args []string) {
 		fmt.Println("Integrity check: pass")
 	}
 
-	store.Close()
-	snapshotStore.Close()
+	err = target.close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	m.Counters = sa.Counters
+	m.Stats = addSnapshotStats(target.stats...)
+
+	// prune chain data
+	fmt.Println("Pruning the chain data...")
+	err = os.MkdirAll(snapshotChainPath, 0755)
+	if err != nil {
+		fmt.Println("Enable to create snapshot chain folder")
+		return
+	}
+	snapshotChainStore := db.NewDB(db.BadgerImpl, snapshotChainPath)
+	nbBlocks, err := pruneChain(chainStore, snapshotChainStore, snapshotNo, keepBlocks)
+	snapshotChainStore.Close()
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Number of blocks kept in the chain: ", nbBlocks)
+	// the sql recovery points are checked against the state of the last kept blocks
+	nbKept := keepBlocks
+	if nbKept == 0 {
+		nbKept = 1
+	}
+	kept, _, err := keptRoots(chainStore, snapshotNo, nbKept)
 	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	// copy other state data (not pruned)
-	fmt.Println("Copying the rest of the chain data (chain, statesql)...")
-	copyDir(chainPath, snapshotChainPath)
-	copyDir(sqlPath, snapshotSqlPath)
+	// copy the sql databases of the snapshot contracts at the snapshot recovery points
+	fmt.Println("Copying the sql state of contracts (statesql)...")
+	err = snapshotSql(store, sqlPath, snapshotSqlPath, kept, sv)
+	store.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// write the manifest once all the snapshot files are written
+	err = writeManifest(snapshotPath, m)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// display results of general trie info
 	displayResults(sa, contractTrie)
 	displayFolderSizes(dbPath, "Size information BEFORE snapshot:")
 	displayFolderSizes(snapshotPath, "Size information AFTER snapshot:")
+}
 
-	/* Sample code to use when pruning chain db and resetting latest
-
-	// Prune chain data
-	blockIdx := types.BlockNoToBytes(11758998)
-	block0Idx := types.BlockNoToBytes(0)
+// snapshotTarget copies the snapshot state to a badger db, to an archive or to chunks
+type snapshotTarget struct {
+	store   db.DB
+	file    *os.File
+	archive *stool.ArchiveWriter
+	// chunks index of the chunks format
+	chunks       *stool.ChunkIndex
+	chunksPath   string
+	nbVoteChunks int
+	// base is the root of the base snapshot of a delta snapshot
+	base []byte
+	// stats of each snapshot written to the target
+	stats []stool.SnapshotStats
+}
 
-	// set snapshot chain block
-	chainDbPath := path.Join(dbPath, "chain")
-	chainStore := db.NewDB(db.BadgerImpl, chainDbPath)
-	blockHash := chainStore.Get(blockIdx)
-	block0Hash := chainStore.Get(block0Idx)
-	if len(blockHash) == 0 {
-		fmt.Println("block hash")
-		return
+// newSnapshotTarget creates the snapshot db, the archive or the chunks folder
+// in snapshotPath with the manifest m as archive header or chunk index info
+func newSnapshotTarget(format, snapshotPath string, m *manifest) (*snapshotTarget, error) {
+	if format == badgerFormat {
+		statePath := path.Join(snapshotPath, "state")
+		err := os.MkdirAll(statePath, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Enable to create snapshot state folder")
+		}
+		return &snapshotTarget{store: db.NewDB(db.BadgerImpl, statePath)}, nil
 	}
-	//block := types.Block{}
-	raw := chainStore.Get(blockHash)
-	raw0 := chainStore.Get(block0Hash)
-	if raw == nil || len(raw) == 0 {
-		fmt.Println("failed to load block data")
-		return
+	info, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
 	}
-		err = proto.Unmarshal(raw, block)
+	root, err := base58.Decode(m.StateRoot)
+	if err != nil {
+		return nil, err
+	}
+	var voteRoots [][]byte
+	for _, voteRoot := range m.VoteRoots {
+		voteRootBytes, err := base58.Decode(voteRoot)
 		if err != nil {
-			fmt.Println("failed to unmarshall block")
-			return
+			return nil, err
 		}
-		if !bytes.Equal(block.Hash, blockHash) {
-			fmt.Println("loaded block doest't have expected hash")
-			return
+		voteRoots = append(voteRoots, voteRootBytes)
+	}
+	if format == chunksFormat {
+		// check the number of chunks before creating the folder
+		if _, err := stool.StateChunks(nil, chunkBits); err != nil {
+			return nil, err
 		}
-	genesisKey := []byte("chain.genesisInfo")
-	genesisBalanceKey := []byte("chain.genesisBalance")
-	genesis := chainStore.Get(genesisKey)
-	genesisBalance := chainStore.Get(genesisBalanceKey)
-	chainStore.Close()
+		chunksPath := path.Join(snapshotPath, chunksFolder)
+		err := os.MkdirAll(chunksPath, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Enable to create snapshot chunks folder")
+		}
+		index := &stool.ChunkIndex{
+			Version:   stool.ChunkIndexVersion,
+			ChunkBits: chunkBits,
+			Root:      root,
+			VoteRoots: voteRoots,
+			Info:      info,
+		}
+		return &snapshotTarget{chunks: index, chunksPath: chunksPath}, nil
+	}
+	header := &stool.ArchiveHeader{Root: root, VoteRoots: voteRoots, KeyRange: m.KeyRange, Info: info}
+	if len(m.Base) != 0 {
+		header.Base, err = base58.Decode(m.Base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Create(path.Join(snapshotPath, archiveFile))
+	if err != nil {
+		return nil, err
+	}
+	archive, err := stool.NewArchiveWriter(file, header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &snapshotTarget{file: file, archive: archive}, nil
+}
+
+func (t *snapshotTarget) snapshot(sa *stool.StateAnalysis, root []byte) error {
+	if t.chunks != nil {
+		specs, err := stool.StateChunks(root, t.chunks.ChunkBits)
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			err := t.snapshotChunk(sa, spec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	switch {
+	case t.archive != nil && t.base != nil:
+		err = sa.SnapshotDeltaArchive(t.archive, root, t.base)
+	case t.archive != nil:
+		err = sa.SnapshotArchive(t.archive, root)
+	case t.base != nil:
+		err = sa.SnapshotDelta(t.store, root, t.base)
+	default:
+		err = sa.Snapshot(t.store, root)
+	}
+	t.stats = append(t.stats, sa.SnapshotStats())
+	return err
+}
 
-	snapshotChainDbPath := path.Join(snapshotPath, "chain")
-	err = os.MkdirAll(snapshotChainDbPath, 0755)
+func (t *snapshotTarget) snapshotAccount(sa *stool.StateAnalysis, root, trieKey []byte) error {
+	if t.chunks != nil {
+		t.nbVoteChunks++
+		return t.snapshotChunk(sa, stool.AccountChunk(voteChunkName(t.nbVoteChunks), root, trieKey))
+	}
+	var err error
+	switch {
+	case t.archive != nil && t.base != nil:
+		err = sa.SnapshotAccountDeltaArchive(t.archive, root, t.base, trieKey)
+	case t.archive != nil:
+		err = sa.SnapshotAccountArchive(t.archive, root, trieKey)
+	case t.base != nil:
+		err = sa.SnapshotAccountDelta(t.store, root, t.base, trieKey)
+	default:
+		err = sa.SnapshotAccount(t.store, root, trieKey)
+	}
+	t.stats = append(t.stats, sa.SnapshotStats())
+	return err
+}
+
+// snapshotChunk writes a chunk file in the chunks folder
+func (t *snapshotTarget) snapshotChunk(sa *stool.StateAnalysis, spec *stool.ChunkSpec) error {
+	file, err := os.Create(path.Join(t.chunksPath, spec.Name))
 	if err != nil {
-		fmt.Println("Enable to create snapshot state folder")
-		return
+		return err
 	}
-	snapshotChainStore := db.NewDB(db.BadgerImpl, snapshotChainDbPath)
-	// set latest
-	latestKey := []byte("chain.latest")
-	snapshotChainStore.Set(latestKey, blockIdx)
-	snapshotChainStore.Set(blockIdx, blockHash)
-	snapshotChainStore.Set(blockHash, raw)
-	snapshotChainStore.Set(block0Idx, block0Hash)
-	snapshotChainStore.Set(block0Hash, raw0)
-	snapshotChainStore.Set(genesisKey, genesis)
-	snapshotChainStore.Set(genesisBalanceKey, genesisBalance)
-	snapshotChainStore.Close()
-	*/
+	err = sa.SnapshotChunk(file, spec)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.stats = append(t.stats, sa.SnapshotStats())
+	return file.Close()
+}
+
+func (t *snapshotTarget) close() error {
+	if t.chunks != nil {
+		// the index is written last so a mirror only serves complete chunks
+		raw, err := json.MarshalIndent(t.chunks, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path.Join(t.chunksPath, stool.ChunkIndexFile), raw, 0644)
+	}
+	if t.archive != nil {
+		err := t.archive.Close()
+		if err != nil {
+			t.file.Close()
+			return err
+		}
+		return t.file.Close()
+	}
+	t.store.Close()
+	return nil
+}
+
+// voteChunkName is the name of the chunk of the voting contract at the i-th vote root
+func voteChunkName(i int) string {
+	return fmt.Sprintf("vote-%d.chunk", i)
 }
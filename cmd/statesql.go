@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/golang/protobuf/proto"
+	"github.com/mr-tron/base58/base58"
+)
+
+// sqlVisitor collects the sql recovery points of the contracts in the snapshot.
+// The sql database of a contract is named after the base58 trie key of the contract.
+type sqlVisitor struct {
+	lock           sync.Mutex
+	recoveryPoints map[string]uint64
+}
+
+func newSqlVisitor() *sqlVisitor {
+	return &sqlVisitor{recoveryPoints: make(map[string]uint64)}
+}
+
+func (v *sqlVisitor) VisitAccount(leaf *stool.Leaf) error {
+	if len(leaf.Value) == 0 {
+		return nil
+	}
+	data := &types.State{}
+	err := proto.Unmarshal(leaf.Value, data)
+	if err != nil {
+		return err
+	}
+	if data.GetCodeHash() == nil {
+		return nil
+	}
+	v.lock.Lock()
+	v.recoveryPoints[base58.Encode(leaf.TrieKey)] = data.GetSqlRecoveryPoint()
+	v.lock.Unlock()
+	return nil
+}
+
+func (v *sqlVisitor) VisitStorage(leaf *stool.Leaf) error {
+	return nil
+}
+
+// snapshotSql copies the sql databases of the contracts in the snapshot state and
+// rolls each copy back to the recovery point of the contract in the snapshot state.
+// The recovery point is the number of commits of the master branch of the LiteTree
+// database, aergo truncates the branch to the recovery point of the state before
+// executing a contract (contract/statesql.go restoreRecoveryPoint) and a database
+// with less commits than the state cannot be recovered.
+// The recovery points of the contracts at the kept blocks must be restorable from
+// the rolled back databases. A contract that cannot be rolled back fails the snapshot.
+func snapshotSql(store db.DB, sqlPath, snapshotSqlPath string, keptRoots [][]byte, sv *sqlVisitor) error {
+	files, err := ioutil.ReadDir(sqlPath)
+	if os.IsNotExist(err) {
+		// no sql contracts
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = os.MkdirAll(snapshotSqlPath, 0755)
+	if err != nil {
+		return fmt.Errorf("Enable to create snapshot statesql folder")
+	}
+	found := make(map[string]bool)
+	var nbSkipped int
+	for _, f := range files {
+		// copy the database file and the files created with it (lock)
+		i := strings.Index(f.Name(), ".db")
+		if i <= 0 {
+			continue
+		}
+		dbName := f.Name()[:i]
+		if _, ok := sv.recoveryPoints[dbName]; !ok {
+			// contract created after the snapshot height or outside the key range
+			if f.Name() == dbName+".db" {
+				nbSkipped++
+			}
+			continue
+		}
+		found[dbName] = true
+		err = copyDir(path.Join(sqlPath, f.Name()), path.Join(snapshotSqlPath, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println("* Number of sql databases copied: ", len(found))
+	fmt.Println("* Number of sql databases of contracts not in the snapshot: ", nbSkipped)
+
+	var dbNames []string
+	for dbName := range sv.recoveryPoints {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+	dbRecoveryPoints := make(map[stool.Hash]uint64)
+	var nbFailed int
+	for _, dbName := range dbNames {
+		rp := sv.recoveryPoints[dbName]
+		if !found[dbName] {
+			// the recovery point of a new contract is 1 (state.CreateAccountStateV)
+			// and the database is only created when the contract uses sql
+			if rp > 1 {
+				fmt.Println("  - Missing sql database of contract: ", dbName, " recovery point: ", rp)
+				nbFailed++
+			}
+			continue
+		}
+		dbFile := path.Join(snapshotSqlPath, dbName+".db")
+		err := rollbackSql(dbFile, rp)
+		if err != nil {
+			fmt.Println("  - Sql database of contract ", dbName, ": ", err)
+			nbFailed++
+			// an inconsistent database is not part of the snapshot
+			os.Remove(dbFile)
+			os.Remove(dbFile + "-lock")
+			continue
+		}
+		trieKey, err := base58.Decode(dbName)
+		if err != nil {
+			return err
+		}
+		var account stool.Hash
+		copy(account[:], trieKey)
+		dbRecoveryPoints[account] = rp
+	}
+	fmt.Println("* Number of sql databases rolled back to the snapshot recovery point: ", len(dbRecoveryPoints))
+
+	// the kept blocks are restored by truncating the databases further
+	mismatches, err := stool.CheckSqlRecoveryPoints(store, keptRoots, dbRecoveryPoints)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		fmt.Println("  ~ Sql database of contract ", base58.Encode(m.Account), " with ", m.DbRecoveryPoint,
+			" commits cannot serve recovery point ", m.RecoveryPoint, " at state root ", base58.Encode(m.Root))
+	}
+	fmt.Println("* Number of recovery point mismatches with the kept blocks: ", len(mismatches))
+	if nbFailed != 0 {
+		return fmt.Errorf("%d sql databases cannot be rolled back to the recovery point of the snapshot", nbFailed)
+	}
+	return nil
+}
+
+// sqlBranchInfo is the result of the LiteTree pragma branch_info
+type sqlBranchInfo struct {
+	TotalCommits uint64 `json:"total_commits"`
+}
+
+// sqlRecoveryPoint reads the number of commits of the master branch of a sql
+// database, aergo saves it as the recovery point of the contract state
+func sqlRecoveryPoint(dbFile string) (uint64, error) {
+	out, err := execSqlPragma(dbFile, "pragma branch_info(master);")
+	if err != nil {
+		return 0, err
+	}
+	var bi sqlBranchInfo
+	if err := json.Unmarshal(out, &bi); err != nil || bi.TotalCommits == 0 {
+		return 0, fmt.Errorf("cannot read the recovery point with %s, a sqlite shell built with LiteTree branches is required", sqlShell)
+	}
+	return bi.TotalCommits, nil
+}
+
+// rollbackSql truncates the master branch of a sql database to the recovery point rp
+func rollbackSql(dbFile string, rp uint64) error {
+	dbRp, err := sqlRecoveryPoint(dbFile)
+	if err != nil {
+		return err
+	}
+	if dbRp < rp {
+		return fmt.Errorf("the database is behind the state: recovery point %d < %d", dbRp, rp)
+	}
+	if dbRp == rp {
+		return nil
+	}
+	_, err = execSqlPragma(dbFile, fmt.Sprintf("pragma branch_truncate(master.%d);", rp))
+	if err != nil {
+		return err
+	}
+	dbRp, err = sqlRecoveryPoint(dbFile)
+	if err != nil {
+		return err
+	}
+	if dbRp != rp {
+		return fmt.Errorf("the database was truncated to recovery point %d instead of %d", dbRp, rp)
+	}
+	return nil
+}
+
+// execSqlPragma runs a pragma on a sql database opened with branches like aergo does
+func execSqlPragma(dbFile, pragma string) ([]byte, error) {
+	out, err := exec.Command(sqlShell, "file:"+dbFile+"?branches=on", pragma).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v %s", sqlShell, err, strings.TrimSpace(string(out)))
+	}
+	return bytes.TrimSpace(out), nil
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// stateVarKeyPrefix is prepended by the lua vm to state variable names
+	stateVarKeyPrefix = "_sv_"
+)
+
+var (
+	storageKey string
+	varName    string
+	varKey     string
+)
+
+func init() {
+	storageCmd.Flags().StringVarP(&address, "address", "a", "", "Address (b58) or name of the contract to query")
+	storageCmd.Flags().Uint64VarP(&blockHeight, "blockHeight", "b", 0, "Block height of the queried state (default latest)")
+	storageCmd.Flags().StringVarP(&storageKey, "key", "k", "", "Raw storage key (string or 0x prefixed hex)")
+	storageCmd.Flags().StringVar(&varName, "var", "", "Name of the lua state variable")
+	storageCmd.Flags().StringVar(&varKey, "varKey", "", "Key of the state.map or index of the state.array variable")
+	storageCmd.MarkFlagRequired("address")
+	rootCmd.AddCommand(storageCmd)
+}
+
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Get a value in a contract storage",
+	Run:   execStorage,
+}
+
+func execStorage(cmd *cobra.Command, args []string) {
+	statePath := path.Join(dbPath, "state")
+	chainPath := path.Join(dbPath, "chain")
+	// check db path and open db
+	if stat, err := os.Stat(dbPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid database path provided")
+		return
+	}
+	if (len(storageKey) == 0) == (len(varName) == 0) {
+		fmt.Println("choose between key and var flags")
+		return
+	}
+	key, err := getStorageKey()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	addr, err := types.DecodeAddress(address)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	trieKey := types.ToAccountID(addr)
+
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	rootBytes, err := getHeightTrieRoot(chainStore, blockHeight)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	tr := stool.NewTrieReader(store, false)
+	state, err := tr.Get(rootBytes, trieKey[:])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if state == nil {
+		fmt.Println("Contract not found in the state trie")
+		return
+	}
+	if len(state.GetStorageRoot()) == 0 {
+		fmt.Println("Contract storage is empty")
+		return
+	}
+	fmt.Println("\nQuerying contract storage root: ", base58.Encode(state.GetStorageRoot()))
+	value, err := tr.GetStorageValue(state.GetStorageRoot(), stool.Hasher(key))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if value == nil {
+		fmt.Println("Key not found in the contract storage trie")
+		return
+	}
+	displayStorageValue(key, value)
+}
+
+// getStorageKey returns the raw storage key from the key or var flags
+func getStorageKey() ([]byte, error) {
+	if len(varName) != 0 {
+		key := stateVarKeyPrefix + varName
+		if len(varKey) != 0 {
+			key += "-" + varKey
+		}
+		return []byte(key), nil
+	}
+	if strings.HasPrefix(storageKey, "0x") {
+		return hex.DecodeString(storageKey[2:])
+	}
+	return []byte(storageKey), nil
+}
+
+func displayStorageValue(key, value []byte) {
+	fmt.Println("\nStorage value:")
+	fmt.Println("==============")
+	fmt.Println("* Key: ", string(key))
+	fmt.Println("* Value size: ", len(value), " bytes")
+	fmt.Println("* Value (hex): ", hex.EncodeToString(value))
+	// lua state values are stored as json
+	if json.Valid(value) {
+		fmt.Println("* Value (json): ", string(value))
+	}
+}
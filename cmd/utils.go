@@ -2,18 +2,24 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/aergoio/aergo-lib/db"
 	"github.com/aergoio/aergo/types"
 	"github.com/aergoio/state-tools/stool"
 	"github.com/gogo/protobuf/proto"
+	sha256 "github.com/minio/sha256-simd"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
 )
 
 func isEmpty(name string) bool {
@@ -64,30 +70,89 @@ func displayResults(sa *stool.StateAnalysis, contractTrie bool) {
 	if countDBReads {
 		fmt.Println("* Number of DB reads performed to iterate Trie: ", sa.Trie.LoadDbCounter)
 	}
+	for i, reads := range sa.LayerReads() {
+		fmt.Println("* Number of reads served by layer ", i, ": ", reads)
+	}
+}
+
+// folderSizes are the sizes in bytes of a data folder
+type folderSizes struct {
+	Total    int64 `json:"total"`
+	State    int64 `json:"state"`
+	Chain    int64 `json:"chain"`
+	StateSql int64 `json:"statesql"`
+}
+
+func getFolderSizes(dbPath string) *folderSizes {
+	sizes := &folderSizes{}
+	sizes.Total, _ = dirSize(dbPath)
+	sizes.State, _ = dirSize(path.Join(dbPath, "state"))
+	sizes.Chain, _ = dirSize(path.Join(dbPath, "chain"))
+	sizes.StateSql, _ = dirSize(path.Join(dbPath, "statesql"))
+	return sizes
 }
 
 func displayFolderSizes(dbPath, title string) {
-	statePath := path.Join(dbPath, "state")
-	sqlPath := path.Join(dbPath, "statesql")
-	chainPath := path.Join(dbPath, "chain")
-	totalSize, _ := dirSize(dbPath)
-	stateSize, _ := dirSize(statePath)
-	sqlSize, _ := dirSize(sqlPath)
-	chainSize, _ := dirSize(chainPath)
+	sizes := getFolderSizes(dbPath)
 	fmt.Printf("\n%s\n", title)
 	fmt.Println(strings.Repeat("=", len(title)))
-	fmt.Println("* Total blockchain size: ", float64(totalSize)/1024.0/1024.0, " Mb")
-	fmt.Println("* State size: ", float64(stateSize)/1024.0/1024.0, " Mb")
-	fmt.Println("* Chain size: ", float64(chainSize)/1024.0/1024.0, " Mb")
-	fmt.Println("* SQL State size: ", float64(sqlSize)/1024.0/1024.0, " Mb")
+	fmt.Println("* Total blockchain size: ", float64(sizes.Total)/1024.0/1024.0, " Mb")
+	fmt.Println("* State size: ", float64(sizes.State)/1024.0/1024.0, " Mb")
+	fmt.Println("* Chain size: ", float64(sizes.Chain)/1024.0/1024.0, " Mb")
+	fmt.Println("* SQL State size: ", float64(sizes.StateSql)/1024.0/1024.0, " Mb")
+}
+
+func copyDir(sourcePath, destinationPath string) error {
+	out, err := exec.Command("cp", "-r", sourcePath, destinationPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s: %v %s", sourcePath, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func copyDir(sourcePath, destinationPath string) {
-	exec.Command("cp", "-r", sourcePath, destinationPath).Run()
+func addKeyRangeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&startKey, "start", "", "First trie key (hex) of the key range to traverse")
+	cmd.Flags().StringVar(&endKey, "end", "", "Trie key (hex) after the key range to traverse")
+	cmd.Flags().StringVar(&keyPrefix, "prefix", "", "Only traverse trie keys starting with these bits (ex: 0110)")
 }
 
+// getKeyRange returns the key range of the start, end and prefix flags or nil if not set
+func getKeyRange() (*stool.KeyRange, error) {
+	if len(keyPrefix) != 0 {
+		if len(startKey) != 0 || len(endKey) != 0 {
+			return nil, fmt.Errorf("choose between prefix and start/end flags")
+		}
+		return stool.PrefixRange(keyPrefix)
+	}
+	if len(startKey) == 0 && len(endKey) == 0 {
+		return nil, nil
+	}
+	keyRange := &stool.KeyRange{}
+	var err error
+	if len(startKey) != 0 {
+		keyRange.Start, err = hex.DecodeString(startKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(endKey) != 0 {
+		keyRange.End, err = hex.DecodeString(endKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyRange, nil
+}
+
+var (
+	// latestKey is the chain db key of the latest block height
+	latestKey = []byte("chain.latest")
+	// genesisKey and genesisBalanceKey are the chain db keys of the genesis block info
+	genesisKey        = []byte("chain.genesisInfo")
+	genesisBalanceKey = []byte("chain.genesisBalance")
+)
+
 func getLatestTrieRoot(chainStore db.DB) ([]byte, error) {
-	latestKey := []byte("chain.latest")
 	blockIdx := chainStore.Get(latestKey)
 	if blockIdx == nil || len(blockIdx) == 0 {
 		return nil, fmt.Errorf("failed to load latest blockidx")
@@ -96,34 +161,80 @@ func getLatestTrieRoot(chainStore db.DB) ([]byte, error) {
 
 }
 
+// getHeightTrieRoot returns the state root at blockHeight, or the latest state root if blockHeight is 0
+func getHeightTrieRoot(chainStore db.DB, blockHeight uint64) ([]byte, error) {
+	if blockHeight == 0 {
+		return getLatestTrieRoot(chainStore)
+	}
+	return getTrieRoot(chainStore, types.BlockNoToBytes(blockHeight))
+}
+
+// getRootOrHeight returns the state root of a b58 root or a block height
+func getRootOrHeight(chainStore db.DB, rootOrHeight string) ([]byte, error) {
+	if height, err := strconv.ParseUint(rootOrHeight, 10, 64); err == nil {
+		return getTrieRoot(chainStore, types.BlockNoToBytes(height))
+	}
+	return base58.Decode(rootOrHeight)
+}
+
 func getTrieRoot(chainStore db.DB, blockIdx []byte) ([]byte, error) {
-	//blockNo := types.BlockNoFromBytes(blockIdx)
+	block, err := getBlock(chainStore, blockIdx)
+	if err != nil {
+		return nil, err
+	}
+	return block.Header.BlocksRootHash, nil
+}
+
+// getBlock loads the block at blockIdx and checks its hash
+func getBlock(chainStore db.DB, blockIdx []byte) (*types.Block, error) {
 	blockHash := chainStore.Get(blockIdx)
+	if len(blockHash) == 0 {
+		// the block may have been pruned from the chain db
+		return nil, fmt.Errorf("failed to load block hash at height %d", types.BlockNoFromBytes(blockIdx))
+	}
 	blockRaw := chainStore.Get(blockHash)
 	if blockRaw == nil || len(blockRaw) == 0 {
 		return nil, fmt.Errorf("failed to load latest block data")
 	}
-	block := types.Block{}
-	err := proto.Unmarshal(blockRaw, &block)
+	block := &types.Block{}
+	err := proto.Unmarshal(blockRaw, block)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshall block")
 	}
 	if !bytes.Equal(block.Hash, blockHash) {
 		return nil, fmt.Errorf("loaded block doest't have expected hash")
 	}
-	return block.Header.BlocksRootHash, nil
+	return block, nil
 }
 
-func getVoteTrieRoots(chainStore db.DB) ([]byte, []byte, error) {
-	latestKey := []byte("chain.latest")
+// getLatestBlockNo returns the height of chain.latest
+func getLatestBlockNo(chainStore db.DB) (uint64, error) {
 	blockIdx := chainStore.Get(latestKey)
 	if blockIdx == nil || len(blockIdx) == 0 {
-		return nil, nil, fmt.Errorf("failed to load latest blockidx")
+		return 0, fmt.Errorf("failed to load latest blockidx")
 	}
-	blockNo := types.BlockNoFromBytes(blockIdx)
+	return types.BlockNoFromBytes(blockIdx), nil
+}
+
+// getVoteBlockNos returns the heights of the 2 voting periods used by dpos at blockNo
+func getVoteBlockNos(blockNo uint64) (uint64, uint64) {
 	q := blockNo / 100
-	voteBlockNo1 := (q - 1) * 100
-	voteBlockNo2 := q * 100
+	if q == 0 {
+		return 0, 0
+	}
+	return (q - 1) * 100, q * 100
+}
+
+// votingContractKey returns the trie key of the voting contract (aergo.system)
+func votingContractKey() []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte("aergo.system"))
+	return hasher.Sum(nil)
+}
+
+// getVoteTrieRoots returns the state roots of the 2 voting periods used by dpos at blockNo
+func getVoteTrieRoots(chainStore db.DB, blockNo uint64) ([]byte, []byte, error) {
+	voteBlockNo1, voteBlockNo2 := getVoteBlockNos(blockNo)
 	voteBlockIdx1 := types.BlockNoToBytes(voteBlockNo1)
 	voteBlockIdx2 := types.BlockNoToBytes(voteBlockNo2)
 	root1, err := getTrieRoot(chainStore, voteBlockIdx1)
@@ -136,3 +247,72 @@ func getVoteTrieRoots(chainStore db.DB) ([]byte, []byte, error) {
 	}
 	return root1, root2, nil
 }
+
+// pruneChain writes a minimal chain db with chain.latest set to blockNo.
+// It contains the genesis info, block 0, the blocks of the vote trie roots
+// and the last keepBlocks blocks up to blockNo (at least blockNo itself).
+// Returns the number of blocks written.
+func pruneChain(chainStore, snapshotChainStore db.DB, blockNo, keepBlocks uint64) (int, error) {
+	blockNos := map[uint64]bool{0: true, blockNo: true}
+	voteBlockNo1, voteBlockNo2 := getVoteBlockNos(blockNo)
+	blockNos[voteBlockNo1] = true
+	blockNos[voteBlockNo2] = true
+	for i := uint64(1); i < keepBlocks && i <= blockNo; i++ {
+		blockNos[blockNo-i] = true
+	}
+	for no := range blockNos {
+		err := copyBlock(chainStore, snapshotChainStore, no)
+		if err != nil {
+			return 0, err
+		}
+	}
+	txn := snapshotChainStore.NewTx()
+	for _, key := range [][]byte{genesisKey, genesisBalanceKey} {
+		// genesis balance is only stored if the genesis has balances
+		if value := chainStore.Get(key); len(value) != 0 {
+			txn.Set(key, value)
+		}
+	}
+	txn.Set(latestKey, types.BlockNoToBytes(blockNo))
+	txn.Commit()
+	return len(blockNos), nil
+}
+
+// copyBlock copies a block with its receipts and tx index to the snapshot chain db
+func copyBlock(chainStore, snapshotChainStore db.DB, blockNo uint64) error {
+	blockIdx := types.BlockNoToBytes(blockNo)
+	blockHash := chainStore.Get(blockIdx)
+	blockRaw := chainStore.Get(blockHash)
+	if len(blockHash) == 0 || len(blockRaw) == 0 {
+		return fmt.Errorf("failed to load block data at height %d", blockNo)
+	}
+	block := types.Block{}
+	err := proto.Unmarshal(blockRaw, &block)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshall block")
+	}
+	txn := snapshotChainStore.NewTx()
+	txn.Set(blockIdx, blockHash)
+	txn.Set(blockHash, blockRaw)
+	if receipts := chainStore.Get(receiptsKey(blockHash, blockNo)); len(receipts) != 0 {
+		txn.Set(receiptsKey(blockHash, blockNo), receipts)
+	}
+	for _, tx := range block.GetBody().GetTxs() {
+		if txIdx := chainStore.Get(tx.GetHash()); len(txIdx) != 0 {
+			txn.Set(tx.GetHash(), txIdx)
+		}
+	}
+	txn.Commit()
+	return nil
+}
+
+// receiptsKey is the chain db key of the receipts of a block
+func receiptsKey(blockHash []byte, blockNo uint64) []byte {
+	var key bytes.Buffer
+	key.Write([]byte("r"))
+	key.Write(blockHash)
+	l := make([]byte, 8)
+	binary.LittleEndian.PutUint64(l[:], blockNo)
+	key.Write(l)
+	return key.Bytes()
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+var (
+	proofPath  string
+	proofKey   string
+	proofValue string
+)
+
+func init() {
+	verifyProofCmd.Flags().StringVar(&proofPath, "proof", "", "Path/to/proof.json generated by the proof command")
+	verifyProofCmd.Flags().StringVarP(&root, "root", "r", "", "Trusted root (b58) to verify the proof against (default root in proof file)")
+	verifyProofCmd.Flags().StringVarP(&proofKey, "key", "k", "", "Trie key (hex) to verify (default key in proof file)")
+	verifyProofCmd.Flags().StringVar(&proofValue, "value", "", "Raw value (hex) of the key for proofs of inclusion (default value hash in proof file)")
+	verifyProofCmd.MarkFlagRequired("proof")
+	rootCmd.AddCommand(verifyProofCmd)
+}
+
+var verifyProofCmd = &cobra.Command{
+	Use:   "verify-proof",
+	Short: "Verify a merkle proof of inclusion or non-inclusion",
+	Run:   execVerifyProof,
+}
+
+func execVerifyProof(cmd *cobra.Command, args []string) {
+	raw, err := ioutil.ReadFile(proofPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	proof := &stool.Proof{}
+	err = json.Unmarshal(raw, proof)
+	if err != nil {
+		fmt.Println("Failed to parse proof file: ", err)
+		return
+	}
+
+	rootBytes := proof.Root
+	if len(root) != 0 {
+		rootBytes, err = base58.Decode(root)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	keyBytes := proof.Key
+	if len(proofKey) != 0 {
+		keyBytes, err = hex.DecodeString(proofKey)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	var valueHash []byte
+	if proof.Inclusion {
+		valueHash = proof.ProofVal
+		if len(proofValue) != 0 {
+			value, err := hex.DecodeString(proofValue)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			// values are stored in the trie by hash
+			valueHash = stool.Hasher(value)
+		}
+	}
+
+	fmt.Println("\nVerifying proof for root: ", base58.Encode(rootBytes))
+	fmt.Println("* Key: ", hex.EncodeToString(keyBytes))
+	if !stool.VerifyProof(rootBytes, keyBytes, valueHash, proof) {
+		fmt.Println("* Proof verification: FAIL")
+		return
+	}
+	if proof.Inclusion {
+		fmt.Println("* Value hash: ", hex.EncodeToString(valueHash))
+		fmt.Println("* Proof of inclusion verification: pass")
+	} else {
+		fmt.Println("* Proof of non-inclusion verification: pass")
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/aergoio/state-tools/stool"
+	"github.com/mr-tron/base58/base58"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	verifySnapshotCmd.Flags().StringVarP(&snapshotPath, "snapshotPath", "s", "", "Path/to/snapshot/folder/data")
+	verifySnapshotCmd.MarkFlagRequired("snapshotPath")
+	rootCmd.AddCommand(verifySnapshotCmd)
+}
+
+var verifySnapshotCmd = &cobra.Command{
+	Use:   "verify-snapshot",
+	Short: "Verify that a snapshot contains all the nodes of its state",
+	Run:   execVerifySnapshot,
+}
+
+func execVerifySnapshot(cmd *cobra.Command, args []string) {
+	// check snapshot db path
+	if stat, err := os.Stat(snapshotPath); err != nil || !stat.IsDir() {
+		fmt.Println("Invalid path for snapshot database provided")
+		return
+	}
+	statePath := path.Join(snapshotPath, "state")
+	chainPath := path.Join(snapshotPath, "chain")
+
+	chainStore := db.NewDB(db.BadgerImpl, chainPath)
+	latestNo, err := getLatestBlockNo(chainStore)
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	rootBytes, err := getTrieRoot(chainStore, types.BlockNoToBytes(latestNo))
+	if err != nil {
+		chainStore.Close()
+		fmt.Println(err)
+		return
+	}
+	voteRootBytes1, voteRootBytes2, err := getVoteTrieRoots(chainStore, latestNo)
+	chainStore.Close()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// a key range snapshot only contains the accounts of its range
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var keyRange *stool.KeyRange
+	if m != nil {
+		if len(m.Base) != 0 {
+			fmt.Println("A delta snapshot is verified when it is applied with the apply-delta command")
+			return
+		}
+		if m.Format == archiveFormat || m.Format == chunksFormat {
+			fmt.Println("The state of", m.Format, "snapshots is verified by the import command")
+			return
+		}
+		keyRange = m.KeyRange
+	}
+
+	store := db.NewDB(db.BadgerImpl, statePath)
+	defer store.Close()
+	fmt.Println("Snapshot block height: ", latestNo)
+	start := time.Now()
+	sa, missingNodes, err := verifyState(store, rootBytes, [][]byte{voteRootBytes1, voteRootBytes2}, keyRange)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Time to verify snapshot: %v\n", time.Since(start))
+
+	displayResults(sa, false)
+	displayMissingNodes(missingNodes, "Snapshot verification")
+}
+
+// verifyState walks the state of root and the voting contract of the vote roots
+// with an integrity check and returns the missing nodes
+func verifyState(store db.DB, root []byte, voteRoots [][]byte, keyRange *stool.KeyRange) (*stool.StateAnalysis, []*stool.MissingNode, error) {
+	fmt.Println("Verifying state root: ", base58.Encode(root))
+	// the integrity check is required to walk contract storage tries
+	sa := stool.NewStateAnalysis(store, countDBReads, true, true, workers)
+	sa.SetKeyRange(keyRange)
+	sa.CollectMissingNodes()
+	err := sa.Analyse(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	missingNodes := sa.MissingNodes()
+
+	// verify the voting contract state of the vote roots
+	votingContract := votingContractKey()
+	for _, voteRoot := range voteRoots {
+		fmt.Println("Verifying vote root: ", base58.Encode(voteRoot))
+		sva := stool.NewStateAnalysis(store, false, true, true, workers)
+		sva.CollectMissingNodes()
+		err = sva.AnalyseAccount(voteRoot, votingContract)
+		if err != nil {
+			return nil, nil, err
+		}
+		missingNodes = append(missingNodes, sva.MissingNodes()...)
+	}
+	return sa, missingNodes, nil
+}
+
+// displayMissingNodes prints the missing nodes and exits with an error code if any
+func displayMissingNodes(missingNodes []*stool.MissingNode, title string) {
+	fmt.Printf("\n%s results:\n", title)
+	fmt.Println(strings.Repeat("=", len(title)+9))
+	for _, m := range missingNodes {
+		fmt.Println("* ", m.Kind, ": ", base58.Encode(m.Hash), " at height ", m.Height)
+	}
+	fmt.Println("* Number of missing nodes: ", len(missingNodes))
+	if len(missingNodes) != 0 {
+		fmt.Printf("%s: failed\n", title)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: pass\n", title)
+}
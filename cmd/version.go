@@ -6,6 +6,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// version of state-tools recorded in snapshot manifests
+const version = "v0.1"
+
 func init() {
 	rootCmd.AddCommand(versionCmd)
 }
@@ -14,6 +17,6 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version number of state-tools",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("v0.1")
+		fmt.Println(version)
 	},
 }
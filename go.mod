@@ -1,6 +1,6 @@
 module github.com/aergoio/state-tools
 
-go 1.12
+go 1.13
 
 require (
 	github.com/aergoio/aergo v1.2.2
@@ -10,4 +10,5 @@ require (
 	github.com/minio/sha256-simd v0.1.0
 	github.com/mr-tron/base58 v1.1.2
 	github.com/spf13/cobra v0.0.5
+	github.com/sunpuyo/badger v0.0.0-20181022123248-bb757672e2c7
 )
@@ -0,0 +1,334 @@
+package stool
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+// An archive is a single file snapshot of a state independent of the db backend.
+// After the magic bytes, a gzip stream contains:
+//   - the length prefixed json ArchiveHeader
+//   - the entries: kind byte, 32 bytes key, length prefixed value
+//   - an end marker (kind 0), the number of entries and the sha256 of the
+//     previous bytes of the stream
+//
+// Lengths are encoded as uvarints.
+var archiveMagic = []byte("AERGOSTA")
+
+const (
+	// ArchiveVersion is the version of the archive format
+	ArchiveVersion = 1
+
+	archiveEnd      byte = 0
+	archiveTrieNode byte = 1
+	archiveValue    byte = 2
+	archiveCode     byte = 3
+
+	// maxRecentEntries limits the memory used to skip duplicate entries
+	maxRecentEntries = 1 << 20
+)
+
+// ArchiveHeader describes the state contained in an archive
+type ArchiveHeader struct {
+	Version uint32 `json:"version"`
+	// Root is the state root of the archive
+	Root []byte `json:"root"`
+	// VoteRoots are the roots of which only the voting contract was archived
+	VoteRoots [][]byte `json:"voteRoots,omitempty"`
+	// KeyRange restricts the accounts of Root included in the archive
+	KeyRange *KeyRange `json:"keyRange,omitempty"`
+	// Base is the root of the snapshot a delta archive applies to, nil for a full archive
+	Base []byte `json:"base,omitempty"`
+	// Info is free data about the archive (snapshot manifest)
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+// ArchiveWriter streams the entries copied by a snapshot to an archive.
+// An entry referenced several times in the state may be written more than once.
+type ArchiveWriter struct {
+	lock   sync.Mutex
+	gz     *gzip.Writer
+	hasher hash.Hash
+	out    *bufio.Writer
+	// recent entries are skipped when written again
+	recent    map[Hash]struct{}
+	nbEntries uint64
+	stats     SnapshotStats
+	err       error
+}
+
+// NewArchiveWriter writes the archive header to w
+func NewArchiveWriter(w io.Writer, header *ArchiveHeader) (*ArchiveWriter, error) {
+	header.Version = ArchiveVersion
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(archiveMagic)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	hasher := sha256.New()
+	a := &ArchiveWriter{
+		gz:     gz,
+		hasher: hasher,
+		out:    bufio.NewWriter(io.MultiWriter(gz, hasher)),
+		recent: make(map[Hash]struct{}),
+	}
+	a.writeUvarint(uint64(len(raw)))
+	a.write(raw)
+	return a, a.err
+}
+
+func (a *ArchiveWriter) setTrieNode(key, value []byte) {
+	a.lock.Lock()
+	a.stats.NbTrieNodes++
+	a.stats.TrieNodesSize += uint64(len(value))
+	a.writeEntry(archiveTrieNode, key, value)
+	a.lock.Unlock()
+}
+
+func (a *ArchiveWriter) setValue(key, value []byte) {
+	a.lock.Lock()
+	a.stats.NbValues++
+	a.stats.ValuesSize += uint64(len(value))
+	a.writeEntry(archiveValue, key, value)
+	a.lock.Unlock()
+}
+
+func (a *ArchiveWriter) setCode(key, value []byte) {
+	a.lock.Lock()
+	a.stats.NbCodes++
+	a.stats.CodesSize += uint64(len(value))
+	a.writeEntry(archiveCode, key, value)
+	a.lock.Unlock()
+}
+
+func (a *ArchiveWriter) getStats() SnapshotStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.stats
+}
+
+// flush reports the first write error, entries are written as they come
+func (a *ArchiveWriter) flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.err
+}
+
+// Close writes the end of the archive, it doesn't close the underlying writer
+func (a *ArchiveWriter) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.write([]byte{archiveEnd})
+	a.writeUvarint(a.nbEntries)
+	if a.err != nil {
+		return a.err
+	}
+	err := a.out.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = a.gz.Write(a.hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// writeEntry writes an entry, the lock must be held
+func (a *ArchiveWriter) writeEntry(kind byte, key, value []byte) {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	if _, exists := a.recent[dbkey]; exists {
+		return
+	}
+	if len(a.recent) >= maxRecentEntries {
+		a.recent = make(map[Hash]struct{})
+	}
+	a.recent[dbkey] = struct{}{}
+	a.nbEntries++
+	a.write([]byte{kind})
+	a.write(dbkey[:])
+	a.writeUvarint(uint64(len(value)))
+	a.write(value)
+}
+
+func (a *ArchiveWriter) writeUvarint(x uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, x)
+	a.write(buf[:n])
+}
+
+func (a *ArchiveWriter) write(b []byte) {
+	if a.err != nil {
+		return
+	}
+	_, a.err = a.out.Write(b)
+}
+
+// hashReader hashes the bytes read from a buffered reader
+type hashReader struct {
+	r      *bufio.Reader
+	hasher hash.Hash
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hasher.Write(p[:n])
+	return n, err
+}
+
+func (h *hashReader) ReadByte() (byte, error) {
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.hasher.Write([]byte{b})
+	}
+	return b, err
+}
+
+// ReadArchiveHeader reads the header at the beginning of an archive
+func ReadArchiveHeader(r io.Reader) (*ArchiveHeader, error) {
+	header, _, err := readArchiveHeader(r)
+	return header, err
+}
+
+// readArchiveHeader reads the header of an archive and returns the reader of the entries
+func readArchiveHeader(r io.Reader) (*ArchiveHeader, *hashReader, error) {
+	magic := make([]byte, len(archiveMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, archiveMagic) {
+		return nil, nil, fmt.Errorf("not a state archive")
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	in := &hashReader{r: bufio.NewReader(gz), hasher: sha256.New()}
+	headerLen, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := readLength(in, headerLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := &ArchiveHeader{}
+	err = json.Unmarshal(raw, header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse archive header: %v", err)
+	}
+	if header.Version != ArchiveVersion {
+		return nil, nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	return header, in, nil
+}
+
+// readLength reads length bytes, the buffer grows with the data read
+// so that a corrupted length doesn't allocate a huge buffer
+func readLength(r io.Reader, length uint64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// ImportArchive writes the entries of an archive to store and checks the archive checksum.
+// The state should then be verified against the header roots with an integrity check.
+// Entries are written while the archive is read: store should be a new db that
+// is discarded if the archive is rejected.
+func ImportArchive(r io.Reader, store db.DB) (*ArchiveHeader, SnapshotStats, error) {
+	return importArchive(r, store, false)
+}
+
+// ImportArchiveWithRollback imports an archive in a store that already contains
+// a state (delta archive). The keys added to store are kept in memory and deleted
+// if the archive is rejected, so that a failed import leaves store unchanged.
+func ImportArchiveWithRollback(r io.Reader, store db.DB) (*ArchiveHeader, SnapshotStats, error) {
+	return importArchive(r, store, true)
+}
+
+func importArchive(r io.Reader, store db.DB, rollback bool) (*ArchiveHeader, SnapshotStats, error) {
+	header, in, err := readArchiveHeader(r)
+	if err != nil {
+		return nil, SnapshotStats{}, err
+	}
+
+	w := newSnapshotWriter(store, DefaultSnapshotMemory)
+	// added are the keys that were not in store before the import
+	var added [][]byte
+	reject := func(err error) (*ArchiveHeader, SnapshotStats, error) {
+		w.flush()
+		deleteKeys(store, added)
+		return nil, SnapshotStats{}, err
+	}
+	var nbEntries uint64
+	for {
+		kind, err := in.ReadByte()
+		if err != nil {
+			return reject(fmt.Errorf("truncated archive: %v", err))
+		}
+		if kind == archiveEnd {
+			break
+		}
+		key := make([]byte, HashLength)
+		_, err = io.ReadFull(in, key)
+		if err != nil {
+			return reject(fmt.Errorf("truncated archive: %v", err))
+		}
+		valueLen, err := binary.ReadUvarint(in)
+		if err != nil {
+			return reject(fmt.Errorf("truncated archive: %v", err))
+		}
+		value, err := readLength(in, valueLen)
+		if err != nil {
+			return reject(fmt.Errorf("truncated archive: %v", err))
+		}
+		if rollback && !store.Exist(key) {
+			added = append(added, key)
+		}
+		switch kind {
+		case archiveTrieNode:
+			w.setTrieNode(key, value)
+		case archiveValue:
+			w.setValue(key, value)
+		case archiveCode:
+			w.setCode(key, value)
+		default:
+			return reject(fmt.Errorf("unknown archive entry kind %d", kind))
+		}
+		nbEntries++
+	}
+	expectedEntries, err := binary.ReadUvarint(in)
+	if err != nil {
+		return reject(fmt.Errorf("truncated archive: %v", err))
+	}
+	sum := in.hasher.Sum(nil)
+	checksum := make([]byte, sha256.Size)
+	_, err = io.ReadFull(in, checksum)
+	if err != nil {
+		return reject(fmt.Errorf("truncated archive: %v", err))
+	}
+	if expectedEntries != nbEntries || !bytes.Equal(sum, checksum) {
+		return reject(fmt.Errorf("archive checksum failed"))
+	}
+	w.flush()
+	return header, w.getStats(), nil
+}
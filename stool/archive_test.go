@@ -0,0 +1,100 @@
+package stool
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestArchive snapshots a state to an archive and imports it in a new db
+func TestArchive(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	txn := store.NewTx()
+	var keys, values [][]byte
+	for i, key := range getFreshData(10, 32) {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageValues := getFreshData(20, 32)
+		storageTrie.Update(getFreshData(20, 32), storageValues)
+		storageTrie.Commit()
+		for _, v := range storageValues {
+			(txn).Set(v, []byte("storage value"))
+		}
+		code := []byte(fmt.Sprintf("code %d", i))
+		(txn).Set(Hasher(code), code)
+		contract, _ := proto.Marshal(&types.State{CodeHash: Hasher(code), StorageRoot: storageTrie.Root})
+		(txn).Set(Hasher(contract), contract)
+		keys = append(keys, key)
+		values = append(values, Hasher(contract))
+	}
+	txn.(db.Transaction).Commit()
+	smt.Update(keys, values)
+	smt.Commit()
+
+	var buf bytes.Buffer
+	archive, err := NewArchiveWriter(&buf, &ArchiveHeader{Root: smt.Root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := NewStateAnalysis(store, false, true, true, 8)
+	err = sa.SnapshotArchive(archive, smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+
+	importPath := path.Join(".aergo", "import")
+	_ = os.MkdirAll(importPath, 0711)
+	importStore := db.NewDB(db.BadgerImpl, importPath)
+	header, stats, err := ImportArchive(bytes.NewReader(raw), importStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header.Root, smt.Root) {
+		t.Fatal("Expected the archive root in the header")
+	}
+	if stats.NbCodes != 10 || stats.NbValues != 10+10*20 {
+		t.Fatal("Expected to import 10 codes and 210 values, got: ", stats)
+	}
+	v := &countVisitor{storage: make(map[Hash]int)}
+	importAnalysis := NewStateAnalysis(importStore, false, true, true, 8)
+	importAnalysis.AddVisitors(v)
+	importAnalysis.CollectMissingNodes()
+	err = importAnalysis.Analyse(header.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importAnalysis.MissingNodes()) != 0 || importAnalysis.Counters.NbContracts != 10 || len(v.storage) != 10 {
+		t.Fatal("Expected to find the 10 contracts in the imported state")
+	}
+
+	importStore.Close()
+
+	// a corrupted archive is rejected and leaves the store empty
+	corrupted := append([]byte{}, raw...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	rejectPath := path.Join(".aergo", "reject")
+	_ = os.MkdirAll(rejectPath, 0711)
+	rejectStore := db.NewDB(db.BadgerImpl, rejectPath)
+	_, _, err = ImportArchiveWithRollback(bytes.NewReader(corrupted), rejectStore)
+	if err == nil {
+		t.Fatal("Expected a corrupted archive to fail")
+	}
+	if it := rejectStore.Iterator(nil, nil); it.Valid() {
+		t.Fatal("Expected the rejected archive to leave the store empty, found key: ", it.Key())
+	}
+	rejectStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
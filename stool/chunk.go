@@ -0,0 +1,288 @@
+package stool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// A chunk is an archive of the accounts of a key range of a state.
+// The trie node batches on the path from the root to the key range are included
+// so that a chunk can be verified against the state root on its own: the state
+// can be downloaded in chunks from an untrusted mirror and bad chunks rejected
+// before they are written.
+
+const (
+	// ChunkIndexFile describes the chunks of a snapshot
+	ChunkIndexFile = "chunks.json"
+	// ChunkIndexVersion is the version of the chunk index format
+	ChunkIndexVersion = 1
+	// MaxChunkBits limits the number of chunks of a state to 2^MaxChunkBits
+	MaxChunkBits = 16
+)
+
+// ChunkIndex describes the chunks of a snapshot.
+// The roots of an index downloaded from a mirror are not trusted, the chunks
+// are verified against roots read from the chain.
+type ChunkIndex struct {
+	Version uint32 `json:"version"`
+	// ChunkBits is the length of the key prefix of each state chunk
+	ChunkBits int `json:"chunkBits"`
+	// Root is the state root of the state chunks
+	Root []byte `json:"root"`
+	// VoteRoots are the roots of the voting contract chunks
+	VoteRoots [][]byte `json:"voteRoots,omitempty"`
+	// Info is free data about the snapshot (snapshot manifest)
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+// ChunkSpec is the content expected in a chunk
+type ChunkSpec struct {
+	// Name is the file name of the chunk
+	Name string
+	// Root is the state root the chunk is verified against
+	Root []byte
+	// KeyRange contains the accounts of the chunk
+	KeyRange *KeyRange
+}
+
+// StateChunks splits the accounts of the trie of root in 2^chunkBits chunks of equal key prefix length
+func StateChunks(root []byte, chunkBits int) ([]*ChunkSpec, error) {
+	if chunkBits < 0 || chunkBits > MaxChunkBits {
+		return nil, fmt.Errorf("the number of chunk bits must be between 0 and %d", MaxChunkBits)
+	}
+	var specs []*ChunkSpec
+	for i := 0; i < 1<<uint(chunkBits); i++ {
+		keyRange, err := PrefixRange(fmt.Sprintf("%0*b", chunkBits, i)[:chunkBits])
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, &ChunkSpec{
+			Name:     fmt.Sprintf("state-%d.chunk", i),
+			Root:     root,
+			KeyRange: keyRange,
+		})
+	}
+	return specs, nil
+}
+
+// AccountChunk creates the spec of a chunk containing a single account (voting contract)
+func AccountChunk(name string, root, trieKey []byte) *ChunkSpec {
+	return &ChunkSpec{
+		Name:     name,
+		Root:     root,
+		KeyRange: &KeyRange{Start: trieKey, End: prefixEnd(trieKey, 8*HashLength)},
+	}
+}
+
+// SnapshotChunk uses Dfs to stream the accounts of a chunk and the key path
+// nodes to w. The counters of successive chunks are accumulated.
+func (sa *StateAnalysis) SnapshotChunk(w io.Writer, spec *ChunkSpec) error {
+	archive, err := NewArchiveWriter(w, &ArchiveHeader{Root: spec.Root, KeyRange: spec.KeyRange})
+	if err != nil {
+		return err
+	}
+	sa.SetKeyRange(spec.KeyRange)
+	err = sa.SnapshotArchive(archive, spec.Root)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// VerifyChunk reads a chunk, verifies it against spec and writes it to store.
+// The chunk is imported in a temporary badger db created in tmpDir (the default
+// temporary folder if empty) and hashed from the spec root with an integrity
+// check of all the trie nodes, values and codes. The entries of the chunk are
+// written to store only once the whole chunk is verified.
+func VerifyChunk(r io.Reader, spec *ChunkSpec, store db.DB, tmpDir string) (SnapshotStats, error) {
+	dir, err := ioutil.TempDir(tmpDir, "chunk")
+	if err != nil {
+		return SnapshotStats{}, err
+	}
+	defer os.RemoveAll(dir)
+	// db.NewDB sets a global logger, the badger db is created directly for concurrent chunks
+	chunkStore, err := db.NewBadgerDB(dir)
+	if err != nil {
+		return SnapshotStats{}, err
+	}
+	defer chunkStore.Close()
+
+	header, _, err := ImportArchive(r, chunkStore)
+	if err != nil {
+		return SnapshotStats{}, fmt.Errorf("chunk %s: %w", spec.Name, err)
+	}
+	if !bytes.Equal(header.Root, spec.Root) || header.KeyRange == nil ||
+		!bytes.Equal(header.KeyRange.Start, spec.KeyRange.Start) || !bytes.Equal(header.KeyRange.End, spec.KeyRange.End) {
+		return SnapshotStats{}, fmt.Errorf("chunk %s: the root or key range doesn't match the requested chunk", spec.Name)
+	}
+	verifier := NewStateAnalysis(chunkStore, false, true, true, 1)
+	verifier.SetKeyRange(spec.KeyRange)
+	verifier.AddVisitors(&chunkVisitor{store: chunkStore})
+	err = verifier.Analyse(spec.Root)
+	if err != nil {
+		return SnapshotStats{}, fmt.Errorf("chunk %s: %w", spec.Name, err)
+	}
+	// the verified chunk is copied with the default snapshot cache
+	sa := NewStateAnalysis(chunkStore, false, true, false, 1)
+	sa.SetKeyRange(spec.KeyRange)
+	err = sa.Snapshot(store, spec.Root)
+	if err != nil {
+		return SnapshotStats{}, fmt.Errorf("chunk %s: %w", spec.Name, err)
+	}
+	return sa.SnapshotStats(), nil
+}
+
+// chunkVisitor checks that the values and codes of a chunk match their db keys
+type chunkVisitor struct {
+	store db.DB
+}
+
+func (v *chunkVisitor) VisitAccount(leaf *Leaf) error {
+	err := v.checkValue(leaf)
+	if err != nil {
+		return err
+	}
+	if len(leaf.Value) == 0 {
+		return nil
+	}
+	data := &types.State{}
+	err = proto.Unmarshal(leaf.Value, data)
+	if err != nil {
+		return err
+	}
+	codeHash := data.GetCodeHash()
+	if codeHash == nil {
+		return nil
+	}
+	code := v.store.Get(codeHash)
+	if len(code) == 0 {
+		return &ErrMissingNode{Hash: codeHash, Height: leaf.Height}
+	}
+	if h := Hasher(code); !bytes.Equal(h, codeHash) {
+		return &ErrHashMismatch{Expected: codeHash, Got: h, Height: leaf.Height}
+	}
+	return nil
+}
+
+func (v *chunkVisitor) VisitStorage(leaf *Leaf) error {
+	return v.checkValue(leaf)
+}
+
+// checkValue checks that the value of a leaf is the preimage of its value hash
+func (v *chunkVisitor) checkValue(leaf *Leaf) error {
+	if !v.store.Exist(leaf.ValueHash) {
+		return &ErrMissingNode{Hash: leaf.ValueHash, Height: leaf.Height}
+	}
+	if h := Hasher(leaf.Value); !bytes.Equal(h, leaf.ValueHash) {
+		return &ErrHashMismatch{Expected: leaf.ValueHash, Got: h, Height: leaf.Height}
+	}
+	return nil
+}
+
+// FetchChunkIndex downloads the chunk index of a snapshot mirror
+func FetchChunkIndex(client *http.Client, baseURL string) (*ChunkIndex, error) {
+	body, err := fetch(client, baseURL, ChunkIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	index := &ChunkIndex{}
+	err = json.NewDecoder(body).Decode(index)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse chunk index: %v", err)
+	}
+	if index.Version != ChunkIndexVersion {
+		return nil, fmt.Errorf("unsupported chunk index version %d", index.Version)
+	}
+	return index, nil
+}
+
+// FetchChunks downloads the chunks of specs from a snapshot mirror with parallel
+// requests, verifies them in temporary dbs of tmpDir and writes them to store.
+// The download stops at the first chunk that fails verification, the chunks
+// already written to store are valid parts of the state.
+func FetchChunks(client *http.Client, baseURL string, specs []*ChunkSpec, store db.DB, tmpDir string, parallel uint) (SnapshotStats, error) {
+	if parallel == 0 {
+		parallel = 1
+	}
+	var (
+		lock     sync.Mutex
+		total    SnapshotStats
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan *ChunkSpec)
+	for i := uint(0); i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for spec := range queue {
+				stats, err := fetchChunk(client, baseURL, spec, store, tmpDir)
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				total = addStats(total, stats)
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, spec := range specs {
+		lock.Lock()
+		failed := firstErr != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+		queue <- spec
+	}
+	close(queue)
+	wg.Wait()
+	return total, firstErr
+}
+
+func fetchChunk(client *http.Client, baseURL string, spec *ChunkSpec, store db.DB, tmpDir string) (SnapshotStats, error) {
+	body, err := fetch(client, baseURL, spec.Name)
+	if err != nil {
+		return SnapshotStats{}, err
+	}
+	defer body.Close()
+	return VerifyChunk(body, spec, store, tmpDir)
+}
+
+// fetch requests a file of a snapshot mirror
+func fetch(client *http.Client, baseURL, name string) (io.ReadCloser, error) {
+	url := strings.TrimSuffix(baseURL, "/") + "/" + name
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// addStats sums the stats of two snapshots
+func addStats(a, b SnapshotStats) SnapshotStats {
+	return SnapshotStats{
+		NbTrieNodes:   a.NbTrieNodes + b.NbTrieNodes,
+		NbValues:      a.NbValues + b.NbValues,
+		NbCodes:       a.NbCodes + b.NbCodes,
+		TrieNodesSize: a.TrieNodesSize + b.TrieNodesSize,
+		ValuesSize:    a.ValuesSize + b.ValuesSize,
+		CodesSize:     a.CodesSize + b.CodesSize,
+	}
+}
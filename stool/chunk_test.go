@@ -0,0 +1,158 @@
+package stool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestChunks snapshots a state in chunks served by a mirror and downloads them in a new db
+func TestChunks(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	txn := store.NewTx()
+	var keys, values [][]byte
+	for i, key := range getFreshData(250, 32) {
+		var state *types.State
+		if i < 50 {
+			storageTrie := trie.NewTrie(nil, Hasher, store)
+			var storageValues [][]byte
+			for j := 0; j < 10; j++ {
+				value := []byte(fmt.Sprintf("storage value %d %d", i, j))
+				(txn).Set(Hasher(value), value)
+				storageValues = append(storageValues, Hasher(value))
+			}
+			storageTrie.Update(getFreshData(10, 32), storageValues)
+			storageTrie.Commit()
+			code := []byte(fmt.Sprintf("code %d", i))
+			(txn).Set(Hasher(code), code)
+			state = &types.State{CodeHash: Hasher(code), StorageRoot: storageTrie.Root}
+		} else {
+			state = &types.State{Nonce: uint64(i), Balance: []byte{byte(i)}}
+		}
+		raw, _ := proto.Marshal(state)
+		(txn).Set(Hasher(raw), raw)
+		keys = append(keys, key)
+		values = append(values, Hasher(raw))
+	}
+	txn.(db.Transaction).Commit()
+	smt.Update(keys, values)
+	smt.Commit()
+	// the first account (a contract) is snapshot on its own like the voting contract
+	account := keys[0]
+
+	specs, err := StateChunks(smt.Root, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 8 {
+		t.Fatal("Expected 8 chunks, got: ", len(specs))
+	}
+	specs = append(specs, AccountChunk("vote-1.chunk", smt.Root, account))
+	chunks := make(map[string][]byte)
+	sa := NewStateAnalysis(store, false, true, true, 4)
+	for _, spec := range specs {
+		var buf bytes.Buffer
+		err = sa.SnapshotChunk(&buf, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[spec.Name] = buf.Bytes()
+	}
+	// the account chunk is counted again
+	if sa.Counters.NbContracts != 51 || sa.Counters.NbUserAccounts != 200 {
+		t.Fatal("Expected the counters of all the chunks, got: ", sa.Counters.NbContracts, sa.Counters.NbUserAccounts)
+	}
+	index, _ := json.Marshal(&ChunkIndex{Version: ChunkIndexVersion, ChunkBits: 3, Root: smt.Root})
+	chunks[ChunkIndexFile] = index
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, exists := chunks[path.Base(r.URL.Path)]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(raw)
+	}))
+	defer server.Close()
+
+	importPath := path.Join(".aergo", "import")
+	_ = os.MkdirAll(importPath, 0711)
+	importStore := db.NewDB(db.BadgerImpl, importPath)
+	fetchedIndex, err := FetchChunkIndex(server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchSpecs, err := StateChunks(smt.Root, fetchedIndex.ChunkBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchSpecs = append(fetchSpecs, AccountChunk("vote-1.chunk", smt.Root, account))
+	stats, err := FetchChunks(server.Client(), server.URL, fetchSpecs, importStore, "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NbCodes != 51 || stats.NbValues != 251+51*10 {
+		t.Fatal("Expected to import 51 codes and 761 values, got: ", stats)
+	}
+	importAnalysis := NewStateAnalysis(importStore, false, true, true, 8)
+	importAnalysis.CollectMissingNodes()
+	err = importAnalysis.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importAnalysis.MissingNodes()) != 0 || importAnalysis.Counters.NbContracts != 50 || importAnalysis.Counters.NbUserAccounts != 200 {
+		t.Fatal("Expected to find all the accounts in the imported state")
+	}
+
+	// a chunk of another key range is rejected
+	chunks["state-1.chunk"] = chunks["state-2.chunk"]
+	_, err = FetchChunks(server.Client(), server.URL, fetchSpecs[1:2], importStore, "", 1)
+	if err == nil {
+		t.Fatal("Expected a chunk of another key range to be rejected")
+	}
+	// a chunk with a tampered value is rejected
+	key := keys[100]
+	tampered, _ := proto.Marshal(&types.State{Nonce: 1, Balance: []byte{255}})
+	store.Set(values[100], tampered)
+	var buf bytes.Buffer
+	chunkIndex := int(key[0] >> 5)
+	err = NewStateAnalysis(store, false, true, false, 4).SnapshotChunk(&buf, specs[chunkIndex])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyChunk(bytes.NewReader(buf.Bytes()), specs[chunkIndex], importStore, "")
+	if err == nil {
+		t.Fatal("Expected a chunk with a tampered value to be rejected")
+	}
+	// a chunk with a tampered node of another key range in a boundary batch is rejected
+	rootBatch := append([]byte{}, store.Get(smt.Root)...)
+	rootBatch[len(rootBatch)-2] ^= 0xff
+	store.Set(smt.Root, rootBatch)
+	buf.Reset()
+	err = NewStateAnalysis(store, false, true, false, 4).SnapshotChunk(&buf, specs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyChunk(bytes.NewReader(buf.Bytes()), specs[0], importStore, "")
+	if err == nil {
+		t.Fatal("Expected a chunk with a tampered boundary batch to be rejected")
+	}
+	// a missing chunk fails the download
+	_, err = FetchChunks(server.Client(), server.URL, []*ChunkSpec{{Name: "missing.chunk"}}, importStore, "", 1)
+	if err == nil {
+		t.Fatal("Expected a missing chunk to fail")
+	}
+	importStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
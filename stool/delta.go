@@ -0,0 +1,203 @@
+package stool
+
+import (
+	"bytes"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+// A delta snapshot contains the trie nodes, values and codes reachable from a root
+// and not from a base root, so that it can be applied to a snapshot of the base root.
+// The tries of both roots are walked together and the subtrees with equal node
+// hashes at the same position are skipped. A node of the new trie that is also
+// in the base trie at another position is copied again, which is harmless.
+
+// deltaWalk walks a trie and the trie of the base root at the same time
+type deltaWalk struct {
+	sa *StateAnalysis
+	// base reads the base trie without copying its nodes
+	base *TrieReader
+	// baseRoot is the root of the base trie for looking up the base value of changed leaves
+	baseRoot []byte
+	// generalTrie differenciates the general trie from a contract storage trie
+	generalTrie bool
+	// account is the trie key of the contract of a storage trie
+	account []byte
+}
+
+// SnapshotDelta copies the entries reachable from root and not from baseRoot to snapStore.
+// The counters and visitors only see the accounts that changed.
+func (sa *StateAnalysis) SnapshotDelta(snapStore db.DB, root, baseRoot []byte) error {
+	sa.snapStore = snapStore
+	sa.accountKey = nil
+	return sa.snapshotDelta(newSnapshotWriter(snapStore, sa.snapshotMemory), root, baseRoot)
+}
+
+// SnapshotDeltaArchive streams the entries reachable from root and not from baseRoot to an archive
+func (sa *StateAnalysis) SnapshotDeltaArchive(archive *ArchiveWriter, root, baseRoot []byte) error {
+	sa.accountKey = nil
+	return sa.snapshotDelta(archive, root, baseRoot)
+}
+
+// SnapshotAccountDelta copies the key path and state of a single account (voting contract)
+// reachable from root and not from baseRoot to snapStore
+func (sa *StateAnalysis) SnapshotAccountDelta(snapStore db.DB, root, baseRoot, trieKey []byte) error {
+	sa.snapStore = snapStore
+	sa.accountKey = trieKey
+	return sa.snapshotDelta(newSnapshotWriter(snapStore, sa.snapshotMemory), root, baseRoot)
+}
+
+// SnapshotAccountDeltaArchive streams the key path and state of a single account
+// reachable from root and not from baseRoot to an archive
+func (sa *StateAnalysis) SnapshotAccountDeltaArchive(archive *ArchiveWriter, root, baseRoot, trieKey []byte) error {
+	sa.accountKey = trieKey
+	return sa.snapshotDelta(archive, root, baseRoot)
+}
+
+// CopyEntries writes all the entries of a snapshot db (a delta) to store and
+// returns the stats of the copied entries classified from their content.
+// The keys that are not hashes are skipped, the other entries of unknown class
+// are copied without being counted.
+func CopyEntries(from, to db.DB) (SnapshotStats, error) {
+	w := newSnapshotWriter(to, DefaultSnapshotMemory)
+	for it := from.Iterator(nil, nil); it.Valid(); it.Next() {
+		w.setEntry(it.Key(), it.Value())
+	}
+	err := w.flush()
+	return w.getStats(), err
+}
+
+// snapshotDelta walks root and baseRoot with a snapshot sink and writes the remaining cached nodes.
+// The walk is sequential: a delta is small compared to the state.
+func (sa *StateAnalysis) snapshotDelta(sink snapshotSink, root, baseRoot []byte) error {
+	sa.snapshot = true
+	sa.snapWriter = sink
+	sa.Trie = sa.newTrieReader(sa.countDbReads)
+	sa.Trie.snapWriter = sink
+	w := &deltaWalk{
+		sa:          sa,
+		base:        sa.newTrieReader(false),
+		baseRoot:    baseRoot,
+		generalTrie: sa.generalTrie,
+	}
+	err := w.walk(root, baseRoot, nil, nil, 0, 0, sa.Trie.TrieHeight)
+	if err != nil {
+		return err
+	}
+	return sink.flush()
+}
+
+func (w *deltaWalk) walk(root, base []byte, batch, baseBatch [][]byte, iBatch, iBaseBatch, height int) error {
+	if len(root) == 0 {
+		return nil
+	}
+	if len(base) != 0 && bytes.Equal(root[:HashLength], base[:HashLength]) {
+		// shared subtree
+		return nil
+	}
+	// the batches of the new trie are copied when loaded
+	batch, iBatch, lnode, rnode, isShortcut, err := w.sa.Trie.LoadChildren(root, height, iBatch, batch)
+	if err != nil {
+		return err
+	}
+	if isShortcut {
+		return w.leaf(lnode[:HashLength], rnode[:HashLength], height)
+	}
+	var baseLnode, baseRnode []byte
+	if len(base) != 0 {
+		var baseIsShortcut bool
+		baseBatch, iBaseBatch, baseLnode, baseRnode, baseIsShortcut, err = w.base.LoadChildren(base, height, iBaseBatch, baseBatch)
+		if err != nil {
+			return err
+		}
+		if baseIsShortcut {
+			// the children of a shortcut are its key and value
+			baseLnode, baseRnode = nil, nil
+		}
+	}
+	accountKey := w.sa.accountKey
+	if w.generalTrie && accountKey != nil {
+		// only follow the key path of the account
+		if bitIsSet(accountKey, w.sa.Trie.TrieHeight-height) {
+			return w.walk(rnode, baseRnode, batch, baseBatch, 2*iBatch+2, 2*iBaseBatch+2, height-1)
+		}
+		return w.walk(lnode, baseLnode, batch, baseBatch, 2*iBatch+1, 2*iBaseBatch+1, height-1)
+	}
+	err = w.walk(lnode, baseLnode, batch, baseBatch, 2*iBatch+1, 2*iBaseBatch+1, height-1)
+	if err != nil {
+		return err
+	}
+	return w.walk(rnode, baseRnode, batch, baseBatch, 2*iBatch+2, 2*iBaseBatch+2, height-1)
+}
+
+// leaf copies the value of a leaf that is not in the base trie at the same position.
+// The leaf may only have moved: nothing is copied if the base trie has the same value for key.
+func (w *deltaWalk) leaf(key, valueHash []byte, height int) error {
+	sa := w.sa
+	if w.generalTrie && sa.accountKey != nil && !bytes.Equal(sa.accountKey, key) {
+		// the account is not included in the trie
+		return nil
+	}
+	baseValueHash, baseHeight, err := w.base.get(w.baseRoot, key, nil, 0, w.base.TrieHeight)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(baseValueHash, valueHash) {
+		return nil
+	}
+	raw := sa.Trie.dbGet(valueHash)
+	if len(raw) == 0 && !sa.Trie.dbExist(valueHash) {
+		// nil objects are stored as empty values, a lost value would drop the contract state
+		return &ErrMissingNode{Hash: valueHash, Height: height, Path: pathBits(key, sa.Trie.TrieHeight-height)}
+	}
+	leaf := &Leaf{TrieKey: key, ValueHash: valueHash, Value: raw, Height: height, Account: w.account}
+	if !w.generalTrie {
+		for _, v := range sa.visitors {
+			err := v.VisitStorage(leaf)
+			if err != nil {
+				return err
+			}
+		}
+		sa.snapWriter.setValue(valueHash, raw)
+		return nil
+	}
+	storageRoot, codeHash, err := sa.parseAccount(raw)
+	if err != nil {
+		return err
+	}
+	for _, v := range sa.visitors {
+		err := v.VisitAccount(leaf)
+		if err != nil {
+			return err
+		}
+	}
+	var baseStorageRoot, baseCodeHash []byte
+	if baseValueHash != nil {
+		baseState, err := w.base.loadState(baseValueHash, baseHeight)
+		if err != nil {
+			return err
+		}
+		baseStorageRoot, baseCodeHash = baseState.GetStorageRoot(), baseState.GetCodeHash()
+	}
+	if storageRoot != nil {
+		storage := &deltaWalk{
+			sa:       sa,
+			base:     w.base,
+			baseRoot: baseStorageRoot,
+			account:  key,
+		}
+		err := storage.walk(storageRoot, baseStorageRoot, nil, nil, 0, 0, sa.Trie.TrieHeight)
+		if err != nil {
+			return err
+		}
+	}
+	if codeHash != nil && !bytes.Equal(codeHash, baseCodeHash) {
+		code := sa.Trie.dbGet(codeHash)
+		if len(code) == 0 {
+			return &ErrMissingNode{Hash: codeHash, Height: height, Path: pathBits(key, sa.Trie.TrieHeight-height)}
+		}
+		sa.snapWriter.setCode(codeHash, code)
+	}
+	sa.snapWriter.setValue(valueHash, raw)
+	return nil
+}
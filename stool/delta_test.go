@@ -0,0 +1,152 @@
+package stool
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestSnapshotDelta applies the delta between 2 state roots to a snapshot of the base root
+func TestSnapshotDelta(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	values := storeStates(store, 1000, 0)
+	// the first 10 accounts are contracts with the same code
+	code := []byte("contract code")
+	store.Set(Hasher(code), code)
+	var storageTries []*trie.Trie
+	for i := 0; i < 10; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(20, 32), storeValues(store, 20, 0))
+		storageTrie.Commit()
+		storageTries = append(storageTries, storageTrie)
+		values[i] = storeContract(store, code, storageTrie.Root, 0)
+	}
+	smt.Update(keys, values)
+	smt.Commit()
+	baseRoot := smt.Root
+
+	snapPath := path.Join(".aergo", "snapshot")
+	_ = os.MkdirAll(snapPath, 0711)
+	snapStore := db.NewDB(db.BadgerImpl, snapPath)
+	err := NewStateAnalysis(store, false, true, false, 8).Snapshot(snapStore, baseRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change 10 accounts, add 10 accounts, change the storage of 2 contracts
+	// and add a contract with a new code
+	smt.Update(keys[500:510], storeStates(store, 10, 1))
+	smt.Update(getFreshData(10, 32), storeStates(store, 10, 2))
+	for i := 0; i < 2; i++ {
+		storageTries[i].Update(getFreshData(1, 32), storeValues(store, 1, 1))
+		storageTries[i].Commit()
+		smt.Update(keys[i:i+1], [][]byte{storeContract(store, code, storageTries[i].Root, 1)})
+	}
+	newCode := []byte("new contract code")
+	store.Set(Hasher(newCode), newCode)
+	storageTrie := trie.NewTrie(nil, Hasher, store)
+	storageTrie.Update(getFreshData(5, 32), storeValues(store, 5, 2))
+	storageTrie.Commit()
+	smt.Update(getFreshData(1, 32), [][]byte{storeContract(store, newCode, storageTrie.Root, 2)})
+	smt.Commit()
+	root := smt.Root
+
+	var buf bytes.Buffer
+	archive, err := NewArchiveWriter(&buf, &ArchiveHeader{Root: root, Base: baseRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := NewStateAnalysis(store, false, true, false, 8)
+	err = sa.SnapshotDeltaArchive(archive, root, baseRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sa.SnapshotStats()
+	// 10 changed, 10 added, 2 changed contracts with 1 new storage value each,
+	// 1 new contract with 5 storage values
+	if stats.NbValues != 10+10+2*2+1+5 || stats.NbCodes != 1 {
+		t.Fatal("Expected the delta to contain 30 values and 1 code, got: ", stats)
+	}
+	if sa.Counters.NbContracts != 3 || sa.Counters.NbUserAccounts != 20 {
+		t.Fatal("Expected the counters of the changed accounts, got: ", sa.Counters.NbContracts, sa.Counters.NbUserAccounts)
+	}
+
+	header, _, err := ImportArchive(bytes.NewReader(buf.Bytes()), snapStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header.Base, baseRoot) {
+		t.Fatal("Expected the base root in the delta header")
+	}
+	for _, r := range [][]byte{baseRoot, root} {
+		verify := NewStateAnalysis(snapStore, false, true, true, 8)
+		verify.CollectMissingNodes()
+		err = verify.Analyse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verify.MissingNodes()) != 0 {
+			t.Fatal("Expected the snapshot with the delta to contain the state of both roots")
+		}
+	}
+
+	// the delta of a root with itself is empty
+	deltaPath := path.Join(".aergo", "delta")
+	_ = os.MkdirAll(deltaPath, 0711)
+	deltaStore := db.NewDB(db.BadgerImpl, deltaPath)
+	sa = NewStateAnalysis(store, false, true, false, 8)
+	err = sa.SnapshotDelta(deltaStore, root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.SnapshotStats() != (SnapshotStats{}) {
+		t.Fatal("Expected an empty delta between identical roots")
+	}
+
+	// a lost contract value or code fails the delta instead of dropping the contract state
+	contractValue, _, _ := NewTrieReader(store, false).get(root, keys[0], nil, 0, 256)
+	for _, lost := range [][]byte{contractValue, Hasher(newCode)} {
+		raw := store.Get(lost)
+		store.Delete(lost)
+		sa = NewStateAnalysis(store, false, true, false, 8)
+		err = sa.SnapshotDelta(deltaStore, root, baseRoot)
+		if e, ok := err.(*ErrMissingNode); !ok || !bytes.Equal(e.Hash, lost) {
+			t.Fatal("Expected the missing entry to fail the delta, got: ", err)
+		}
+		store.Set(lost, raw)
+	}
+	deltaStore.Close()
+	snapStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// storeValues stores n different storage values and returns their db keys
+func storeValues(store db.DB, n int, version byte) [][]byte {
+	var dbKeys [][]byte
+	for _, value := range getFreshData(n, 32) {
+		value = append(value, version)
+		store.Set(Hasher(value), value)
+		dbKeys = append(dbKeys, Hasher(value))
+	}
+	return dbKeys
+}
+
+// storeContract stores a contract state and returns its db key
+func storeContract(store db.DB, code, storageRoot []byte, nonce uint64) []byte {
+	raw, _ := proto.Marshal(&types.State{Nonce: nonce, CodeHash: Hasher(code), StorageRoot: storageRoot})
+	store.Set(Hasher(raw), raw)
+	return Hasher(raw)
+}
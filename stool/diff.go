@@ -0,0 +1,223 @@
+package stool
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+)
+
+// AccountDiff is an account that differs between two state roots.
+// Old is nil if the account was added and New is nil if it was removed.
+type AccountDiff struct {
+	Key []byte
+	Old *types.State
+	New *types.State
+}
+
+// StorageDiff is a contract storage key that differs between two storage roots.
+// OldValue is nil if the key was inserted and NewValue is nil if it was deleted.
+type StorageDiff struct {
+	Key      []byte
+	OldValue []byte
+	NewValue []byte
+}
+
+// leafDiff is a trie key with different value hashes in two tries.
+// oldValue or newValue is nil if the key is not included in the trie.
+type leafDiff struct {
+	key       []byte
+	oldValue  []byte
+	newValue  []byte
+	oldHeight int
+	newHeight int
+}
+
+// trieLeaf is a key and value hash of a shortcut node at height
+type trieLeaf struct {
+	key    []byte
+	value  []byte
+	height int
+}
+
+// Diff returns the accounts that were added, removed or changed between rootA and rootB.
+// Subtrees with equal node hashes in both tries are skipped.
+func Diff(store db.DB, rootA, rootB []byte) ([]*AccountDiff, error) {
+	tr := NewTrieReader(store, false)
+	leafDiffs, err := tr.diffLeaves(rootA, rootB)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []*AccountDiff
+	for _, ld := range leafDiffs {
+		d := &AccountDiff{Key: ld.key}
+		if ld.oldValue != nil {
+			d.Old, err = tr.loadState(ld.oldValue, ld.oldHeight)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ld.newValue != nil {
+			d.New, err = tr.loadState(ld.newValue, ld.newHeight)
+			if err != nil {
+				return nil, err
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// DiffStorage returns the contract storage keys that were inserted, deleted or modified
+// between storage roots rootA and rootB. rootA or rootB can be nil for an empty storage.
+func DiffStorage(store db.DB, rootA, rootB []byte) ([]*StorageDiff, error) {
+	tr := NewTrieReader(store, false)
+	leafDiffs, err := tr.diffLeaves(rootA, rootB)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []*StorageDiff
+	for _, ld := range leafDiffs {
+		d := &StorageDiff{Key: ld.key}
+		if ld.oldValue != nil {
+			d.OldValue, err = tr.loadStorageValue(ld.oldValue, ld.oldHeight)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ld.newValue != nil {
+			d.NewValue, err = tr.loadStorageValue(ld.newValue, ld.newHeight)
+			if err != nil {
+				return nil, err
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// loadStorageValue fetches the raw storage value stored at valueKey referenced by a leaf at height.
+// A missing value is an error, it would otherwise show as an insert or delete.
+func (s *TrieReader) loadStorageValue(valueKey []byte, height int) ([]byte, error) {
+	raw := s.dbGet(valueKey)
+	if len(raw) == 0 {
+		return nil, &ErrMissingNode{Hash: valueKey, Height: height}
+	}
+	return raw, nil
+}
+
+// diffLeaves walks both tries at once and returns the leaves that differ sorted by key
+func (s *TrieReader) diffLeaves(rootA, rootB []byte) ([]leafDiff, error) {
+	var diffs []leafDiff
+	err := s.diff(rootA, rootB, nil, nil, 0, 0, s.TrieHeight, &diffs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return bytes.Compare(diffs[i].key, diffs[j].key) < 0
+	})
+	return diffs, nil
+}
+
+func (s *TrieReader) diff(a, b []byte, batchA, batchB [][]byte, iBatchA, iBatchB, height int, diffs *[]leafDiff) error {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a) != 0 && len(b) != 0 && bytes.Equal(a[:HashLength], b[:HashLength]) {
+		// identical subtrees
+		return nil
+	}
+	var lnodeA, rnodeA, lnodeB, rnodeB []byte
+	isLeafA, isLeafB := len(a) == 0, len(b) == 0
+	var err error
+	if len(a) != 0 {
+		batchA, iBatchA, lnodeA, rnodeA, isLeafA, err = s.LoadChildren(a, height, iBatchA, batchA)
+		if err != nil {
+			return err
+		}
+	}
+	if len(b) != 0 {
+		batchB, iBatchB, lnodeB, rnodeB, isLeafB, err = s.LoadChildren(b, height, iBatchB, batchB)
+		if err != nil {
+			return err
+		}
+	}
+	if isLeafA || isLeafB {
+		// one side is empty or a shortcut: compare the leaves of both subtrees
+		var leavesA, leavesB []trieLeaf
+		if len(a) != 0 {
+			leavesA, err = s.leaves(lnodeA, rnodeA, isLeafA, batchA, iBatchA, height, nil)
+			if err != nil {
+				return err
+			}
+		}
+		if len(b) != 0 {
+			leavesB, err = s.leaves(lnodeB, rnodeB, isLeafB, batchB, iBatchB, height, nil)
+			if err != nil {
+				return err
+			}
+		}
+		*diffs = append(*diffs, compareLeaves(leavesA, leavesB)...)
+		return nil
+	}
+	err = s.diff(lnodeA, lnodeB, batchA, batchB, 2*iBatchA+1, 2*iBatchB+1, height-1, diffs)
+	if err != nil {
+		return err
+	}
+	return s.diff(rnodeA, rnodeB, batchA, batchB, 2*iBatchA+2, 2*iBatchB+2, height-1, diffs)
+}
+
+// leaves appends all the leaves of the subtree of loaded children lnode and rnode
+func (s *TrieReader) leaves(lnode, rnode []byte, isShortcut bool, batch [][]byte, iBatch, height int, leaves []trieLeaf) ([]trieLeaf, error) {
+	if isShortcut {
+		return append(leaves, trieLeaf{key: lnode[:HashLength], value: rnode[:HashLength], height: height}), nil
+	}
+	for i, node := range [][]byte{lnode, rnode} {
+		if len(node) == 0 {
+			continue
+		}
+		b, iB, l, r, isLeaf, err := s.LoadChildren(node, height-1, 2*iBatch+1+i, batch)
+		if err != nil {
+			return nil, err
+		}
+		leaves, err = s.leaves(l, r, isLeaf, b, iB, height-1, leaves)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
+
+// compareLeaves returns the differences between two lists of leaves
+func compareLeaves(leavesA, leavesB []trieLeaf) []leafDiff {
+	var diffs []leafDiff
+	values := make(map[Hash]trieLeaf, len(leavesA))
+	for _, leaf := range leavesA {
+		var key Hash
+		copy(key[:], leaf.key)
+		values[key] = leaf
+	}
+	for _, leaf := range leavesB {
+		var key Hash
+		copy(key[:], leaf.key)
+		old, exists := values[key]
+		if !exists {
+			diffs = append(diffs, leafDiff{key: leaf.key, newValue: leaf.value, newHeight: leaf.height})
+			continue
+		}
+		delete(values, key)
+		if !bytes.Equal(old.value, leaf.value) {
+			diffs = append(diffs, leafDiff{key: leaf.key, oldValue: old.value, newValue: leaf.value,
+				oldHeight: old.height, newHeight: leaf.height})
+		}
+	}
+	for _, leaf := range leavesA {
+		var key Hash
+		copy(key[:], leaf.key)
+		if _, removed := values[key]; removed {
+			diffs = append(diffs, leafDiff{key: leaf.key, oldValue: leaf.value, oldHeight: leaf.height})
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,156 @@
+package stool
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestDiff compares 2 state roots with added, removed and changed accounts
+func TestDiff(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	smt.Update(keys, storeStates(store, 1000, 0))
+	smt.Commit()
+	rootA := smt.Root
+
+	// change 10 accounts, remove 10 accounts and add 10 accounts
+	changed := keys[100:110]
+	removed := keys[500:510]
+	added := getFreshData(10, 32)
+	smt.Update(changed, storeStates(store, 10, 1))
+	defaults := make([][]byte, len(removed))
+	for i := range defaults {
+		// updating a key with DefaultLeaf deletes it
+		defaults[i] = DefaultLeaf
+	}
+	smt.Update(removed, defaults)
+	smt.Update(added, storeStates(store, 10, 2))
+	smt.Commit()
+	rootB := smt.Root
+
+	diffs, err := Diff(store, rootA, rootB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 30 {
+		t.Fatal("Expected 30 account diffs, got: ", len(diffs))
+	}
+	for i, d := range diffs {
+		if i > 0 && bytes.Compare(diffs[i-1].Key, d.Key) >= 0 {
+			t.Fatal("Diffs are not sorted by key")
+		}
+		switch {
+		case d.Old == nil:
+			if !containsKey(added, d.Key) || d.New.GetNonce() != 2 {
+				t.Fatal("Wrong added account")
+			}
+		case d.New == nil:
+			if !containsKey(removed, d.Key) || d.Old.GetNonce() != 0 {
+				t.Fatal("Wrong removed account")
+			}
+		default:
+			if !containsKey(changed, d.Key) || d.Old.GetNonce() != 0 || d.New.GetNonce() != 1 {
+				t.Fatal("Wrong changed account")
+			}
+		}
+	}
+	diffs, err = Diff(store, rootA, rootA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Fatal("Expected no diff between identical roots, got: ", len(diffs))
+	}
+	// a lost account value is reported instead of a change to an empty account
+	lost, _, _ := NewTrieReader(store, false).get(rootB, changed[0], nil, 0, 256)
+	store.Delete(lost)
+	_, err = Diff(store, rootA, rootB)
+	if e, ok := err.(*ErrMissingNode); !ok || !bytes.Equal(e.Hash, lost) || e.Height == 0 {
+		t.Fatal("Expected the missing account value to be reported, got: ", err)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// storeStates stores n different account states with nonce and returns their db keys
+func storeStates(store db.DB, n int, nonce uint64) [][]byte {
+	var dbKeys [][]byte
+	txn := store.NewTx()
+	for _, balance := range getFreshData(n, 32) {
+		raw, _ := proto.Marshal(&types.State{Nonce: nonce, Balance: balance})
+		dbKey := Hasher(raw)
+		(txn).Set(dbKey, raw)
+		dbKeys = append(dbKeys, dbKey)
+	}
+	txn.(db.Transaction).Commit()
+	return dbKeys
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestDiffStorage compares 2 contract storage roots
+func TestDiffStorage(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(3, 32)
+	values := [][]byte{[]byte("value0"), []byte("value1"), []byte("value2")}
+	var dbKeys [][]byte
+	for _, v := range values {
+		store.Set(Hasher(v), v)
+		dbKeys = append(dbKeys, Hasher(v))
+	}
+	smt.Update(keys[:2], dbKeys[:2])
+	smt.Commit()
+	rootA := smt.Root
+	store.Set(Hasher([]byte("new value1")), []byte("new value1"))
+	smt.Update(keys[1:], [][]byte{Hasher([]byte("new value1")), dbKeys[2]})
+	smt.Commit()
+	rootB := smt.Root
+
+	diffs, err := DiffStorage(store, rootA, rootB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatal("Expected 2 storage diffs, got: ", len(diffs))
+	}
+	for _, d := range diffs {
+		if bytes.Equal(d.Key, keys[1]) {
+			if string(d.OldValue) != "value1" || string(d.NewValue) != "new value1" {
+				t.Fatal("Wrong modified storage value")
+			}
+		} else if !bytes.Equal(d.Key, keys[2]) || d.OldValue != nil || string(d.NewValue) != "value2" {
+			t.Fatal("Wrong inserted storage value")
+		}
+	}
+	// diff from an empty storage
+	diffs, err = DiffStorage(store, nil, rootB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatal("Expected 3 inserted storage keys, got: ", len(diffs))
+	}
+	// a missing value is reported instead of a false delete
+	store.Delete(dbKeys[2])
+	_, err = DiffStorage(store, rootA, rootB)
+	if e, ok := err.(*ErrMissingNode); !ok || !bytes.Equal(e.Hash, dbKeys[2]) {
+		t.Fatal("Expected the missing value to be reported, got: ", err)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
@@ -0,0 +1,71 @@
+package stool
+
+import (
+	"fmt"
+)
+
+// ErrMissingNode is returned when a trie node, value or code referenced in
+// the state is unavailable in the db
+type ErrMissingNode struct {
+	// Hash is the db key of the missing data
+	Hash []byte
+	// Height of the trie node or leaf referencing the missing data
+	Height int
+	// Path is the key path prefix of the node from the root, a string of '0' and '1'.
+	// It is empty for the entries found outside of a trie traversal (diffs, chunks).
+	Path string
+}
+
+func (e *ErrMissingNode) Error() string {
+	return fmt.Sprintf("the node %x at height %d is unavailable in the disk db, db may be corrupted", e.Hash, e.Height)
+}
+
+// ErrHashMismatch is returned when a trie node, value or code doesn't match its hash
+type ErrHashMismatch struct {
+	// Expected is the hash referencing the data
+	Expected []byte
+	// Got is the hash of the data
+	Got []byte
+	// Height of the trie node or leaf
+	Height int
+}
+
+func (e *ErrHashMismatch) Error() string {
+	return fmt.Sprintf("the node %x at height %d doesn't match its hash %x", e.Expected, e.Height, e.Got)
+}
+
+// ErrUndecodableNode is returned when a batch of trie nodes stored in the db
+// has an invalid size or inconsistent nodes
+type ErrUndecodableNode struct {
+	// Hash is the db key of the batch
+	Hash []byte
+	// Height of the batch root
+	Height int
+	// Path is the key path prefix of the batch root, like ErrMissingNode.Path
+	Path string
+}
+
+func (e *ErrUndecodableNode) Error() string {
+	return fmt.Sprintf("the trie node %x at height %d cannot be decoded", e.Hash, e.Height)
+}
+
+// setErrPath sets the path of a node error returned by LoadChildren
+func setErrPath(err error, path string) {
+	switch e := err.(type) {
+	case *ErrMissingNode:
+		e.Path = path
+	case *ErrUndecodableNode:
+		e.Path = path
+	}
+}
+
+// ErrAccountNotFound is returned when the account of a single account
+// traversal is not included in the general trie
+type ErrAccountNotFound struct {
+	// Key is the trie key of the account
+	Key []byte
+}
+
+func (e *ErrAccountNotFound) Error() string {
+	return fmt.Sprintf("the account %x is not in the general trie", e.Key)
+}
@@ -0,0 +1,156 @@
+package stool
+
+import (
+	"sync"
+)
+
+const (
+	// MissingTrieNode is a batch of trie nodes unavailable in the db
+	MissingTrieNode = "missing node"
+	// MissingValue is an account or storage value unavailable in the db
+	MissingValue = "missing value"
+	// MissingCode is a contract code unavailable in the db
+	MissingCode = "missing code"
+	// HashMismatch is a trie node, value or code that doesn't match its hash
+	HashMismatch = "hash mismatch"
+	// BadShortcut is a shortcut leaf that doesn't match its hash or is not on the path of its key
+	BadShortcut = "bad shortcut"
+	// UndecodableNode is a batch of trie nodes that cannot be decoded
+	UndecodableNode = "undecodable node"
+	// UndecodableAccount is an account value that cannot be decoded
+	UndecodableAccount = "undecodable account"
+)
+
+// MissingNode is a trie node, value or code referenced in the state but
+// unavailable in the db, or corrupted when collecting integrity failures.
+// The subtree of a missing node is skipped and the traversal continues.
+type MissingNode struct {
+	// Hash is the hash of the node or the db key of the value or code
+	Hash []byte `json:"hash"`
+	// Computed is the hash of the content when it doesn't match Hash
+	Computed []byte `json:"computed,omitempty"`
+	// Path is the key path prefix of the node from the root, a string of '0' and '1'
+	Path string `json:"path"`
+	// Height of the trie node or leaf referencing the data
+	Height int `json:"height"`
+	// Kind is one of the Missing kinds, or a corruption kind (HashMismatch...)
+	// when collecting integrity failures
+	Kind string `json:"kind"`
+	// Account is the trie key of the contract of a storage trie node
+	Account []byte `json:"account,omitempty"`
+}
+
+// IntegrityReport lists the integrity failures of a state
+type IntegrityReport struct {
+	Root []byte `json:"root"`
+	// NbFailures counts the failures of each kind
+	NbFailures map[string]int `json:"nbFailures"`
+	Failures   []*MissingNode `json:"failures"`
+}
+
+// missingNodes records the missing nodes of a Dfs and of its contract storage analyses
+type missingNodes struct {
+	lock  sync.Mutex
+	nodes []*MissingNode
+	// corruption also records the corrupted nodes instead of failing
+	corruption bool
+}
+
+func (m *missingNodes) add(node *MissingNode) {
+	m.lock.Lock()
+	m.nodes = append(m.nodes, node)
+	m.lock.Unlock()
+}
+
+// CollectMissingNodes makes Dfs record the missing nodes and skip them
+// instead of failing at the first missing node.
+func (sa *StateAnalysis) CollectMissingNodes() {
+	sa.missing = &missingNodes{}
+}
+
+// CollectIntegrityFailures makes Dfs check the integrity of the state, record
+// the missing and corrupted nodes and skip them instead of stopping at the first failure.
+func (sa *StateAnalysis) CollectIntegrityFailures() {
+	sa.integrityCheck = true
+	sa.missing = &missingNodes{corruption: true}
+}
+
+// MissingNodes returns the missing nodes recorded by Dfs, with the corrupted
+// nodes when collecting integrity failures
+func (sa *StateAnalysis) MissingNodes() []*MissingNode {
+	if sa.missing == nil {
+		return nil
+	}
+	sa.missing.lock.Lock()
+	defer sa.missing.lock.Unlock()
+	return sa.missing.nodes
+}
+
+// IntegrityReport returns the failures recorded by the Dfs of root
+func (sa *StateAnalysis) IntegrityReport(root []byte) *IntegrityReport {
+	report := &IntegrityReport{
+		Root:       root,
+		NbFailures: make(map[string]int),
+		Failures:   sa.MissingNodes(),
+	}
+	if report.Failures == nil {
+		report.Failures = []*MissingNode{}
+	}
+	for _, f := range report.Failures {
+		report.NbFailures[f.Kind]++
+	}
+	return report
+}
+
+// collectsCorruption returns true if the corrupted nodes are recorded instead of failing
+func (sa *StateAnalysis) collectsCorruption() bool {
+	return sa.missing != nil && sa.missing.corruption
+}
+
+// record records a missing node, or a corrupted node when collecting integrity
+// failures, and returns true if the traversal can skip it
+func (sa *StateAnalysis) record(hash, computed, path []byte, height int, kind string) bool {
+	if sa.missing == nil {
+		return false
+	}
+	if kind != MissingTrieNode && kind != MissingValue && kind != MissingCode && !sa.missing.corruption {
+		return false
+	}
+	sa.missing.add(&MissingNode{
+		Hash:     hash,
+		Computed: computed,
+		Path:     pathBits(path, 256-height),
+		Height:   height,
+		Kind:     kind,
+		Account:  sa.account,
+	})
+	return true
+}
+
+// pathBits returns the first depth bits of path as a string of '0' and '1'
+func pathBits(path []byte, depth int) string {
+	if path == nil {
+		return ""
+	}
+	bits := make([]byte, depth)
+	for i := 0; i < depth; i++ {
+		bits[i] = '0'
+		if bitIsSet(path, i) {
+			bits[i] = '1'
+		}
+	}
+	return string(bits)
+}
+
+// hasPrefix returns true if the first depth bits of key are the bits of path
+func hasPrefix(key, path []byte, depth int) bool {
+	if path == nil {
+		return true
+	}
+	for i := 0; i < depth; i++ {
+		if bitIsSet(key, i) != bitIsSet(path, i) {
+			return false
+		}
+	}
+	return true
+}
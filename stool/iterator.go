@@ -0,0 +1,179 @@
+package stool
+
+import (
+	"bytes"
+)
+
+// Iterator yields the leaves of a trie in ascending key order.
+// It is not safe for concurrent use.
+type Iterator struct {
+	trie *TrieReader
+	root []byte
+	// stack of nodes left to visit, the top is the next node in key order
+	stack []iterFrame
+	// seek is the lower bound of the next leaf key
+	seek []byte
+	// exclusive excludes seek itself from the iteration (resuming after a cursor)
+	exclusive bool
+	// end is the upper bound (excluded) of the iteration, nil if unbounded
+	end []byte
+	// key and valueHash of the current leaf
+	key       []byte
+	valueHash []byte
+	// lastKey is the key of the last leaf returned since the last reset
+	lastKey []byte
+	// done is true when all the leaves were returned
+	done bool
+	err  error
+}
+
+// iterFrame is a node to visit and its position in the trie
+type iterFrame struct {
+	node   []byte
+	batch  [][]byte
+	iBatch int
+	height int
+	// onSeekPath is true if the node is on the key path of seek
+	onSeekPath bool
+}
+
+// Cursor records the position of an Iterator so a scan can be resumed later
+type Cursor struct {
+	// Root of the iterated trie
+	Root []byte `json:"root"`
+	// Key is the lower bound of the remaining leaves, nil to start from the first leaf
+	Key []byte `json:"key,omitempty"`
+	// Exclusive is true if the leaf at Key was already returned
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Done is true if all the leaves were returned
+	Done bool `json:"done,omitempty"`
+	// End is the upper bound (excluded) of a range iteration
+	End []byte `json:"end,omitempty"`
+}
+
+// NewIterator creates an Iterator positioned before the first leaf of the trie of given root
+func (s *TrieReader) NewIterator(root []byte) *Iterator {
+	it := &Iterator{trie: s, root: root}
+	it.reset(nil, false)
+	return it
+}
+
+// NewRangeIterator creates an Iterator over the leaves of keyRange
+func (s *TrieReader) NewRangeIterator(root []byte, keyRange *KeyRange) *Iterator {
+	it := &Iterator{trie: s, root: root, end: keyRange.End}
+	it.reset(keyRange.Start, false)
+	return it
+}
+
+// ResumeIterator creates an Iterator positioned at the cursor saved by a previous scan
+func (s *TrieReader) ResumeIterator(cursor *Cursor) *Iterator {
+	it := &Iterator{trie: s, root: cursor.Root, end: cursor.End}
+	it.reset(cursor.Key, cursor.Exclusive)
+	if cursor.Done {
+		it.stack = nil
+		it.done = true
+	}
+	return it
+}
+
+// Seek positions the iterator so that Next returns the first leaf with a key >= key
+func (it *Iterator) Seek(key []byte) {
+	it.reset(key, false)
+}
+
+// Next moves to the next leaf and returns false when the iteration is finished or failed
+func (it *Iterator) Next() bool {
+	it.key, it.valueHash = nil, nil
+	for len(it.stack) != 0 && it.err == nil {
+		f := it.stack[len(it.stack)-1]
+		it.stack = it.stack[:len(it.stack)-1]
+		if len(f.node) == 0 {
+			continue
+		}
+		batch, iBatch, lnode, rnode, isShortcut, err := it.trie.LoadChildren(f.node, f.height, f.iBatch, f.batch)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if isShortcut {
+			if f.onSeekPath && it.beforeSeek(lnode[:HashLength]) {
+				continue
+			}
+			if it.end != nil && bytes.Compare(lnode[:HashLength], it.end) >= 0 {
+				// leaves are ordered so the iteration is finished
+				it.stack = nil
+				break
+			}
+			it.key, it.valueHash = lnode[:HashLength], rnode[:HashLength]
+			it.lastKey = it.key
+			return true
+		}
+		right := iterFrame{rnode, batch, 2*iBatch + 2, f.height - 1, false}
+		left := iterFrame{lnode, batch, 2*iBatch + 1, f.height - 1, false}
+		if f.onSeekPath {
+			if bitIsSet(it.seek, it.trie.TrieHeight-f.height) {
+				// all the keys of the left subtree are smaller than seek
+				right.onSeekPath = true
+				it.stack = append(it.stack, right)
+				continue
+			}
+			left.onSeekPath = true
+		}
+		// push right first so that left is visited first
+		it.stack = append(it.stack, right, left)
+	}
+	if it.err == nil {
+		it.done = true
+	}
+	return false
+}
+
+// Key returns the trie key of the current leaf
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// ValueHash returns the db key of the value of the current leaf
+func (it *Iterator) ValueHash() []byte {
+	return it.valueHash
+}
+
+// Value fetches the raw value of the current leaf in the db
+func (it *Iterator) Value() []byte {
+	if it.valueHash == nil {
+		return nil
+	}
+	return it.trie.dbGet(it.valueHash)
+}
+
+// Err returns the error that stopped the iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Cursor returns the position of the iterator to resume the scan with ResumeIterator
+func (it *Iterator) Cursor() *Cursor {
+	if it.done {
+		return &Cursor{Root: it.root, Done: true, End: it.end}
+	}
+	if it.lastKey != nil {
+		return &Cursor{Root: it.root, Key: it.lastKey, Exclusive: true, End: it.end}
+	}
+	// no leaf was returned since the last Seek
+	return &Cursor{Root: it.root, Key: it.seek, Exclusive: it.exclusive, End: it.end}
+}
+
+// reset restarts the iteration from the root with a new lower bound
+func (it *Iterator) reset(seek []byte, exclusive bool) {
+	it.seek = seek
+	it.exclusive = exclusive
+	it.key, it.valueHash, it.lastKey, it.err = nil, nil, nil, nil
+	it.done = false
+	it.stack = []iterFrame{{node: it.root, height: it.trie.TrieHeight, onSeekPath: seek != nil}}
+}
+
+// beforeSeek returns true if key is below the lower bound of the iteration
+func (it *Iterator) beforeSeek(key []byte) bool {
+	cmp := bytes.Compare(key, it.seek)
+	return cmp < 0 || (cmp == 0 && it.exclusive)
+}
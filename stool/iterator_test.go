@@ -0,0 +1,126 @@
+package stool
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// TestIterator iterates all the leaves of a trie in key order
+func TestIterator(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	values := getFreshData(1000, 32)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	tr := NewTrieReader(store, false)
+	it := tr.NewIterator(smt.Root)
+	i := 0
+	for it.Next() {
+		if !bytes.Equal(it.Key(), keys[i]) || !bytes.Equal(it.ValueHash(), values[i]) {
+			t.Fatal("Leaves are not iterated in key order")
+		}
+		i++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if i != len(keys) {
+		t.Fatal("Expected to iterate 1000 leaves, got: ", i)
+	}
+
+	// seek included and non included keys
+	it.Seek(keys[500])
+	if !it.Next() || !bytes.Equal(it.Key(), keys[500]) {
+		t.Fatal("Seek to an included key failed")
+	}
+	seekKey := make([]byte, 32)
+	copy(seekKey, keys[500])
+	seekKey[31]++
+	it.Seek(seekKey)
+	if !it.Next() || !bytes.Equal(it.Key(), keys[501]) {
+		t.Fatal("Seek to a non included key failed")
+	}
+	it.Seek(bytes.Repeat([]byte{0xff}, 32))
+	if it.Next() {
+		t.Fatal("Expected no leaf after the last key")
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestIteratorResume stops a scan and resumes it from a serialized cursor
+func TestIteratorResume(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	smt.Update(keys, getFreshData(1000, 32))
+	smt.Commit()
+
+	tr := NewTrieReader(store, false)
+	it := tr.NewIterator(smt.Root)
+	var iterated [][]byte
+	for {
+		// iterate pages of 300 leaves
+		for j := 0; j < 300 && it.Next(); j++ {
+			iterated = append(iterated, it.Key())
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		raw, err := json.Marshal(it.Cursor())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor := &Cursor{}
+		if err = json.Unmarshal(raw, cursor); err != nil {
+			t.Fatal(err)
+		}
+		if cursor.Done {
+			break
+		}
+		it = tr.ResumeIterator(cursor)
+	}
+	if len(iterated) != len(keys) {
+		t.Fatal("Expected to iterate 1000 leaves, got: ", len(iterated))
+	}
+	for i := range keys {
+		if !bytes.Equal(iterated[i], keys[i]) {
+			t.Fatal("Resumed scan is not in key order")
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestRangeIterator iterates the leaves of a key range
+func TestRangeIterator(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	smt.Update(keys, getFreshData(1000, 32))
+	smt.Commit()
+
+	tr := NewTrieReader(store, false)
+	it := tr.NewRangeIterator(smt.Root, &KeyRange{Start: keys[100], End: keys[200]})
+	i := 100
+	for it.Next() {
+		if !bytes.Equal(it.Key(), keys[i]) {
+			t.Fatal("Leaves are not iterated in key order")
+		}
+		i++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if i != 200 {
+		t.Fatal("Expected to stop the iteration at the end of the range, stopped at: ", i)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
@@ -0,0 +1,91 @@
+package stool
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// KeyRange restricts a traversal to the trie keys in [Start, End).
+// A nil Start or End leaves the range unbounded on that side.
+type KeyRange struct {
+	Start []byte `json:"start,omitempty"`
+	End   []byte `json:"end,omitempty"`
+}
+
+// PrefixRange returns the range of keys starting with the given bits.
+// bits is a string of '0' and '1', for example "0110".
+func PrefixRange(bits string) (*KeyRange, error) {
+	if len(bits) > 8*HashLength {
+		return nil, fmt.Errorf("key prefix is longer than %d bits", 8*HashLength)
+	}
+	start := make([]byte, HashLength)
+	for i, b := range bits {
+		switch b {
+		case '1':
+			bitSet(start, i)
+		case '0':
+		default:
+			return nil, fmt.Errorf("key prefix must only contain 0 and 1 bits")
+		}
+	}
+	end := prefixEnd(start, len(bits))
+	return &KeyRange{Start: start, End: end}, nil
+}
+
+// Contains returns true if key is in the range
+func (r *KeyRange) Contains(key []byte) bool {
+	if r.Start != nil && bytes.Compare(key, r.Start) < 0 {
+		return false
+	}
+	if r.End != nil && bytes.Compare(key, r.End) >= 0 {
+		return false
+	}
+	return true
+}
+
+// overlaps returns true if the subtree of keys starting with the first depth
+// bits of path contains keys in the range
+func (r *KeyRange) overlaps(path []byte, depth int) bool {
+	if r.End != nil && bytes.Compare(path, r.End) >= 0 {
+		// the smallest key of the subtree (path followed by 0 bits) is after the range
+		return false
+	}
+	if r.Start != nil {
+		last := make([]byte, HashLength)
+		copy(last, path)
+		for i := depth; i < 8*HashLength; i++ {
+			bitSet(last, i)
+		}
+		if bytes.Compare(last, r.Start) < 0 {
+			// the largest key of the subtree is before the range
+			return false
+		}
+	}
+	return true
+}
+
+// prefixEnd returns the first key after all the keys starting with the first
+// depth bits of prefix, or nil if there is none
+func prefixEnd(prefix []byte, depth int) []byte {
+	end := make([]byte, HashLength)
+	copy(end, prefix)
+	// add 1 at bit depth-1 and propagate the carry
+	for i := depth - 1; i >= 0; i-- {
+		if !bitIsSet(end, i) {
+			bitSet(end, i)
+			return end
+		}
+		bitUnset(end, i)
+	}
+	return nil
+}
+
+// childPath returns the path of a child node at depth with the bit of the step set for right
+func childPath(path []byte, depth int, right bool) []byte {
+	child := make([]byte, HashLength)
+	copy(child, path)
+	if right {
+		bitSet(child, depth)
+	}
+	return child
+}
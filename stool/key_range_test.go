@@ -0,0 +1,35 @@
+package stool
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixRange(t *testing.T) {
+	r, err := PrefixRange("01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Start[0] != 0x40 || r.End[0] != 0x80 || !bytes.Equal(r.Start[1:], r.End[1:]) {
+		t.Fatal("Wrong prefix range: ", r.Start, r.End)
+	}
+	r, err = PrefixRange("11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.End != nil {
+		t.Fatal("Expected the last prefix range to be unbounded")
+	}
+	if _, err = PrefixRange("012"); err == nil {
+		t.Fatal("Expected error for a prefix that isn't made of bits")
+	}
+	// subtree of keys starting with 1 doesn't overlap [0x00.., 0x40..)
+	r = &KeyRange{End: make([]byte, HashLength)}
+	r.End[0] = 0x40
+	if r.overlaps(childPath(make([]byte, HashLength), 0, true), 1) {
+		t.Fatal("Expected subtree to be outside the range")
+	}
+	if !r.overlaps(childPath(make([]byte, HashLength), 0, false), 1) {
+		t.Fatal("Expected subtree to overlap the range")
+	}
+}
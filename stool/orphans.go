@@ -0,0 +1,123 @@
+package stool
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// TrieNodeKey is a batch of trie nodes
+	TrieNodeKey = "trie node"
+	// AccountValueKey is the state of an account
+	AccountValueKey = "account value"
+	// StorageValueKey is a value of a contract storage
+	StorageValueKey = "storage value"
+	// CodeKey is a contract code
+	CodeKey = "code"
+	// UnknownKey is a key that is not a state entry
+	UnknownKey = "unknown"
+
+	// maxUnknownKeys limits the number of unknown keys listed in an orphans report
+	maxUnknownKeys = 100
+)
+
+// KeyClasses lists the classes of the state db keys in display order
+var KeyClasses = []string{TrieNodeKey, AccountValueKey, StorageValueKey, CodeKey, UnknownKey}
+
+// luaJITHeader starts the bytecode of a contract code after the code length
+var luaJITHeader = []byte("\x1bLJ")
+
+// ClassStats counts the keys of a class and the size of their entries
+type ClassStats struct {
+	Nb   uint64 `json:"nb"`
+	Size uint64 `json:"size"`
+}
+
+// OrphansReport counts the reachable and unreachable keys of a state db per class
+type OrphansReport struct {
+	Reachable   map[string]*ClassStats `json:"reachable"`
+	Unreachable map[string]*ClassStats `json:"unreachable"`
+	// UnknownKeys are the first unknown keys found in the db
+	UnknownKeys [][]byte `json:"unknownKeys,omitempty"`
+}
+
+// Orphans iterates every key of store and classifies it as a trie node,
+// account value, storage value, code or unknown key.
+// The class of a reachable key is known from the traversal that marked it,
+// an unreachable key is classified from its content.
+func Orphans(store db.DB, r *Reachable) *OrphansReport {
+	report := &OrphansReport{
+		Reachable:   make(map[string]*ClassStats),
+		Unreachable: make(map[string]*ClassStats),
+	}
+	for _, class := range KeyClasses {
+		report.Reachable[class] = &ClassStats{}
+		report.Unreachable[class] = &ClassStats{}
+	}
+	for it := store.Iterator(nil, nil); it.Valid(); it.Next() {
+		key := it.Key()
+		value := it.Value()
+		stats := report.Reachable
+		var class string
+		if len(key) == HashLength {
+			// a longer key sharing its first 32 bytes with a reachable key is not that key
+			class = r.Class(key)
+		}
+		if len(class) == 0 {
+			stats = report.Unreachable
+			class = classifyEntry(key, value)
+		}
+		if class == UnknownKey && len(report.UnknownKeys) < maxUnknownKeys {
+			// the iterator reuses the key buffer
+			report.UnknownKeys = append(report.UnknownKeys, append([]byte{}, key...))
+		}
+		stats[class].Nb++
+		stats[class].Size += uint64(len(key) + len(value))
+	}
+	return report
+}
+
+// classifyEntry guesses the class of an unreachable entry from its content.
+// Values and codes are stored at the hash of their content, a trie node
+// batch is stored at the hash of its root node so only its encoding is checked.
+func classifyEntry(key, value []byte) string {
+	if len(key) != HashLength {
+		return UnknownKey
+	}
+	if !bytes.Equal(Hasher(value), key) {
+		if len(value) > 4 && validBatchSize(value) {
+			return TrieNodeKey
+		}
+		return UnknownKey
+	}
+	if len(value) == 0 {
+		// nil objects are stored as empty values
+		return AccountValueKey
+	}
+	if isCode(value) {
+		return CodeKey
+	}
+	// an account is a State that encodes back to the same bytes
+	data := &types.State{}
+	if proto.Unmarshal(value, data) == nil {
+		raw, err := proto.Marshal(data)
+		if err == nil && bytes.Equal(raw, value) {
+			return AccountValueKey
+		}
+	}
+	return StorageValueKey
+}
+
+// isCode checks the encoding of a contract code: the little endian length of
+// the LuaJIT bytecode followed by the bytecode and the abi
+func isCode(value []byte) bool {
+	if len(value) < 4+len(luaJITHeader) {
+		return false
+	}
+	codeLen := binary.LittleEndian.Uint32(value)
+	return uint64(codeLen) <= uint64(len(value)-4) && bytes.HasPrefix(value[4:], luaJITHeader)
+}
@@ -0,0 +1,67 @@
+package stool
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// TestOrphans classifies the reachable and unreachable keys of a state db
+func TestOrphans(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(500, 32)
+	values := storeStates(store, 500, 0)
+	code := luaCode("contract code")
+	store.Set(Hasher(code), code)
+	for i := 0; i < 5; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(20, 32), storeValues(store, 20, 0))
+		storageTrie.Commit()
+		values[i] = storeContract(store, code, storageTrie.Root, 0)
+	}
+	smt.Update(keys, values)
+	smt.Commit()
+	// 100 account values and the replaced trie nodes are orphaned
+	smt.Update(keys[100:200], storeStates(store, 100, 1))
+	smt.Commit()
+	oldCode := luaCode("old contract code")
+	store.Set(Hasher(oldCode), oldCode)
+	store.Set([]byte("state.latest"), smt.Root)
+	store.Set(Hasher([]byte("stray")), []byte("junk"))
+	// a longer key starting with a reachable key
+	store.Set(append(Hasher(code), 'x'), code)
+
+	r := NewReachable()
+	err := NewStateAnalysis(store, false, true, false, 8).Mark(r, smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Orphans(store, r)
+	reachable, unreachable := report.Reachable, report.Unreachable
+	if reachable[AccountValueKey].Nb != 500 || reachable[StorageValueKey].Nb != 5*20 ||
+		reachable[CodeKey].Nb != 1 || reachable[UnknownKey].Nb != 0 || reachable[TrieNodeKey].Nb == 0 {
+		t.Fatal("Expected the classes of the reachable keys")
+	}
+	// the 5 states replaced by contracts and the 100 old states
+	if unreachable[AccountValueKey].Nb != 5+100 || unreachable[StorageValueKey].Nb != 0 ||
+		unreachable[CodeKey].Nb != 1 || unreachable[UnknownKey].Nb != 3 || unreachable[TrieNodeKey].Nb == 0 {
+		t.Fatal("Expected the classes of the unreachable keys, got: ",
+			unreachable[TrieNodeKey], unreachable[AccountValueKey], unreachable[StorageValueKey], unreachable[CodeKey], unreachable[UnknownKey])
+	}
+	if len(report.UnknownKeys) != 3 {
+		t.Fatal("Expected the unknown keys to be listed")
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// luaCode encodes a fake bytecode like a contract code
+func luaCode(bytecode string) []byte {
+	code := make([]byte, 4)
+	binary.LittleEndian.PutUint32(code, uint32(3+len(bytecode)))
+	code = append(code, "\x1bLJ"...)
+	return append(code, bytecode...)
+}
@@ -0,0 +1,167 @@
+package stool
+
+import (
+	"bytes"
+)
+
+// Proof is a merkle proof of inclusion or non-inclusion of Key in the trie of Root.
+// The fields follow the aergo trie MerkleProof and MerkleProofCompressed outputs.
+type Proof struct {
+	Root []byte `json:"root"`
+	Key  []byte `json:"key"`
+	// Inclusion is true if Key is included in the trie
+	Inclusion bool `json:"inclusion"`
+	// ProofKey is the key of the leaf on the path of a non-included Key
+	ProofKey []byte `json:"proofKey,omitempty"`
+	// ProofVal is the value hash of Key if included, or the value hash of ProofKey
+	ProofVal []byte `json:"proofVal,omitempty"`
+	// Bitmap is set in compressed proofs to mark non default nodes of the audit path
+	Bitmap []byte `json:"bitmap,omitempty"`
+	// Height is the length of the uncompressed audit path
+	Height int `json:"height"`
+	// AuditPath contains the sibling hashes from the leaf up to the root
+	AuditPath [][]byte `json:"auditPath"`
+}
+
+// Prove generates a merkle proof of inclusion or non-inclusion of key in the trie of given root.
+func (s *TrieReader) Prove(root, key []byte) (*Proof, error) {
+	ap, included, proofKey, proofVal, err := s.merkleProof(root, key, nil, s.TrieHeight, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		Root:      root,
+		Key:       key,
+		Inclusion: included,
+		ProofKey:  proofKey,
+		ProofVal:  proofVal,
+		Height:    len(ap),
+		AuditPath: ap,
+	}, nil
+}
+
+// ProveCompressed generates a merkle proof where default nodes are removed from
+// the audit path and marked in the bitmap.
+func (s *TrieReader) ProveCompressed(root, key []byte) (*Proof, error) {
+	proof, err := s.Prove(root, key)
+	if err != nil {
+		return nil, err
+	}
+	var ap [][]byte
+	bitmap := make([]byte, proof.Height/8+1)
+	for i, node := range proof.AuditPath {
+		if !bytes.Equal(node, DefaultLeaf) {
+			bitSet(bitmap, i)
+			ap = append(ap, node)
+		}
+	}
+	proof.Bitmap = bitmap
+	proof.AuditPath = ap
+	return proof, nil
+}
+
+// merkleProof follows the key path and appends the sibling of each node on
+// the way back up.
+// returns the audit path, bool (key included), key, value, error
+// (key,value) can be 1- (nil, value), value of the included key, 2- the kv of a LeafNode
+// on the path of the non-included key, 3- (nil, nil) for a non-included key
+// with a DefaultLeaf on the path
+func (s *TrieReader) merkleProof(root, key []byte, batch [][]byte, height, iBatch int) ([][]byte, bool, []byte, []byte, error) {
+	if len(root) == 0 {
+		// an empty subtree is on the path of the key
+		return nil, false, nil, nil, nil
+	}
+	batch, iBatch, lnode, rnode, isShortcut, err := s.LoadChildren(root, height, iBatch, batch)
+	if err != nil {
+		return nil, false, nil, nil, err
+	}
+	if isShortcut {
+		if bytes.Equal(lnode[:HashLength], key) {
+			return nil, true, nil, rnode[:HashLength], nil
+		}
+		// the leaf on the path of the non-included key
+		return nil, false, lnode[:HashLength], rnode[:HashLength], nil
+	}
+	next, sibling, iNext := lnode, rnode, 2*iBatch+1
+	if bitIsSet(key, s.TrieHeight-height) {
+		next, sibling, iNext = rnode, lnode, 2*iBatch+2
+	}
+	mp, included, proofKey, proofVal, err := s.merkleProof(next, key, batch, height-1, iNext)
+	if err != nil {
+		return nil, false, nil, nil, err
+	}
+	if len(sibling) == 0 {
+		return append(mp, DefaultLeaf), included, proofKey, proofVal, nil
+	}
+	return append(mp, sibling[:HashLength]), included, proofKey, proofVal, nil
+}
+
+// VerifyProof recomputes the root of the trie from the proof and returns true if
+// it matches root. value is the value hash of key for proofs of inclusion and is
+// ignored for proofs of non-inclusion.
+func VerifyProof(root, key, value []byte, proof *Proof) bool {
+	trieHeight := 8 * HashLength
+	if proof.Inclusion {
+		if len(key) != HashLength || len(value) != HashLength {
+			return false
+		}
+		leafHash := hashShortcut(key, value, trieHeight-proof.Height)
+		return bytes.Equal(root, verifyAuditPath(proof, key, leafHash))
+	}
+	// Check if an empty subtree is on the key path
+	if len(proof.ProofKey) == 0 {
+		return bytes.Equal(root, verifyAuditPath(proof, key, DefaultLeaf))
+	}
+	// Check another leaf is included and is on the key path
+	if len(proof.ProofKey) != HashLength || len(proof.ProofVal) != HashLength {
+		return false
+	}
+	leafHash := hashShortcut(proof.ProofKey, proof.ProofVal, trieHeight-proof.Height)
+	if !bytes.Equal(root, verifyAuditPath(proof, proof.ProofKey, leafHash)) {
+		return false
+	}
+	for b := 0; b < proof.Height; b++ {
+		if bitIsSet(key, b) != bitIsSet(proof.ProofKey, b) {
+			// the proofKey leaf node is not on the path of the key
+			return false
+		}
+	}
+	return !bytes.Equal(key, proof.ProofKey)
+}
+
+// verifyAuditPath hashes the audit path from the leaf up to the root.
+// The audit path of compressed proofs only contains nodes marked in the bitmap.
+func verifyAuditPath(proof *Proof, key, leafHash []byte) []byte {
+	if len(key) != HashLength || proof.Height < 0 || proof.Height > 8*HashLength {
+		return nil
+	}
+	isCompressed := len(proof.Bitmap) != 0
+	if isCompressed && len(proof.Bitmap) < proof.Height/8+1 {
+		return nil
+	}
+	if !isCompressed && len(proof.AuditPath) != proof.Height {
+		return nil
+	}
+	h := leafHash
+	apIndex := 0
+	for i := 0; i < proof.Height; i++ {
+		// i is the index of the sibling from the leaf up
+		sibling := DefaultLeaf
+		if !isCompressed || bitIsSet(proof.Bitmap, i) {
+			if apIndex >= len(proof.AuditPath) {
+				return nil
+			}
+			sibling = proof.AuditPath[apIndex]
+			apIndex++
+		}
+		if bitIsSet(key, proof.Height-i-1) {
+			h = hashNode(sibling, h)
+		} else {
+			h = hashNode(h, sibling)
+		}
+	}
+	if apIndex != len(proof.AuditPath) {
+		return nil
+	}
+	return h
+}
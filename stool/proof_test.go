@@ -0,0 +1,117 @@
+package stool
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// TestProve compares proofs with the ones generated by the aergo trie package
+func TestProve(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	values := getFreshData(1000, 32)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	tr := NewTrieReader(store, false)
+	// inclusion and non-inclusion proofs
+	for _, key := range append(keys[:50], getFreshData(50, 32)...) {
+		ap, included, proofKey, proofVal, err := smt.MerkleProofR(key, smt.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := tr.Prove(smt.Root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.Inclusion != included || !bytes.Equal(proof.ProofKey, proofKey) || !bytes.Equal(proof.ProofVal, proofVal) {
+			t.Fatal("Proof leaf doesn't match aergo trie proof")
+		}
+		if len(proof.AuditPath) != len(ap) || proof.Height != len(ap) {
+			t.Fatal("Audit path length doesn't match aergo trie proof")
+		}
+		for i := range ap {
+			if !bytes.Equal(proof.AuditPath[i], ap[i]) {
+				t.Fatal("Audit path doesn't match aergo trie proof")
+			}
+		}
+
+		bitmap, apc, length, _, _, _, err := smt.MerkleProofCompressedR(key, smt.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cproof, err := tr.ProveCompressed(smt.Root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cproof.Bitmap, bitmap) || cproof.Height != length || len(cproof.AuditPath) != len(apc) {
+			t.Fatal("Compressed proof doesn't match aergo trie proof")
+		}
+		for i := range apc {
+			if !bytes.Equal(cproof.AuditPath[i], apc[i]) {
+				t.Fatal("Compressed audit path doesn't match aergo trie proof")
+			}
+		}
+		if included && !smt.VerifyInclusion(proof.AuditPath, key, proof.ProofVal) {
+			t.Fatal("Failed to verify inclusion proof with aergo trie")
+		}
+		if !included && !smt.VerifyNonInclusion(proof.AuditPath, key, proof.ProofVal, proof.ProofKey) {
+			t.Fatal("Failed to verify non-inclusion proof with aergo trie")
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestVerifyProof verifies generated proofs and rejects tampered ones
+func TestVerifyProof(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(1000, 32)
+	values := getFreshData(1000, 32)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	tr := NewTrieReader(store, false)
+	for i, key := range keys[:50] {
+		for _, prove := range []func([]byte, []byte) (*Proof, error){tr.Prove, tr.ProveCompressed} {
+			proof, err := prove(smt.Root, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proof.Inclusion || !VerifyProof(smt.Root, key, values[i], proof) {
+				t.Fatal("Failed to verify proof of inclusion")
+			}
+			if VerifyProof(smt.Root, key, values[i+1], proof) {
+				t.Fatal("Verified proof of inclusion with a wrong value")
+			}
+			if VerifyProof(smt.Root, keys[i+1], values[i], proof) {
+				t.Fatal("Verified proof of inclusion with a wrong key")
+			}
+		}
+	}
+	for _, key := range getFreshData(50, 32) {
+		for _, prove := range []func([]byte, []byte) (*Proof, error){tr.Prove, tr.ProveCompressed} {
+			proof, err := prove(smt.Root, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof.Inclusion || !VerifyProof(smt.Root, key, nil, proof) {
+				t.Fatal("Failed to verify proof of non-inclusion")
+			}
+			if len(proof.ProofKey) != 0 && VerifyProof(smt.Root, proof.ProofKey, nil, proof) {
+				t.Fatal("Verified proof of non-inclusion of an included key")
+			}
+			proof.AuditPath[0] = Hasher(proof.AuditPath[0])
+			if VerifyProof(smt.Root, key, nil, proof) {
+				t.Fatal("Verified proof with a tampered audit path")
+			}
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
@@ -0,0 +1,229 @@
+package stool
+
+import (
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+// maxPruneBatch is the number of keys deleted in a transaction
+const maxPruneBatch = 10000
+
+// Reachable is the set of the db keys of the trie nodes, values and codes
+// reachable from state roots. It is a snapshot sink that keeps the keys of
+// the entries and their class instead of copying them, and a leaf visitor
+// that tells account values apart from storage values.
+type Reachable struct {
+	// lock for keys and stats
+	lock sync.Mutex
+	// keys maps the reachable keys to their class
+	keys map[Hash]string
+	// partial is set once the key path of a single account is marked:
+	// the batches of the general trie are not complete subtrees anymore
+	partial bool
+	// stats of the marked entries, an entry is counted once
+	stats SnapshotStats
+}
+
+// PruneStats counts the entries of a state db kept and deleted by a prune
+type PruneStats struct {
+	NbKept      uint64
+	NbDeleted   uint64
+	KeptSize    uint64
+	DeletedSize uint64
+	// NbOther is the number of keys that are not hashes (state.latest), they are kept
+	NbOther uint64
+}
+
+// NewReachable creates an empty set of reachable keys
+func NewReachable() *Reachable {
+	return &Reachable{keys: make(map[Hash]string)}
+}
+
+// Mark uses Dfs to add the entries reachable from root to r.
+// The subtrees already marked from another root are skipped.
+func (sa *StateAnalysis) Mark(r *Reachable, root []byte) error {
+	sa.accountKey = nil
+	return sa.mark(r, root)
+}
+
+// MarkAccount uses Dfs to add the key path and state of a single account
+// (voting contract) to r. The roots should be marked with Mark first so that
+// their subtrees can still be skipped.
+func (sa *StateAnalysis) MarkAccount(r *Reachable, root, trieKey []byte) error {
+	r.lock.Lock()
+	r.partial = true
+	r.lock.Unlock()
+	sa.accountKey = trieKey
+	return sa.mark(r, root)
+}
+
+// mark adds r to the visitors of sa for a single Dfs from root
+func (sa *StateAnalysis) mark(r *Reachable, root []byte) error {
+	visitors := sa.visitors
+	sa.reachable = r
+	sa.visitors = append(visitors[:len(visitors):len(visitors)], r)
+	defer func() {
+		sa.reachable = nil
+		sa.visitors = visitors
+	}()
+	return sa.snapshotDfs(r, root)
+}
+
+// Contains returns true if key is reachable
+func (r *Reachable) Contains(key []byte) bool {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	r.lock.Lock()
+	_, exists := r.keys[dbkey]
+	r.lock.Unlock()
+	return exists
+}
+
+// Class returns the class of a reachable key, or an empty string if key is not reachable
+func (r *Reachable) Class(key []byte) string {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.keys[dbkey]
+}
+
+// Len returns the number of reachable keys
+func (r *Reachable) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.keys)
+}
+
+// marked returns true if the subtree of the batch root key was already marked.
+// Contract storage tries are always marked entirely, a batch of the general
+// trie is only complete when no single account path was marked.
+func (r *Reachable) marked(key []byte, generalTrie bool) bool {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, exists := r.keys[dbkey]
+	return exists && (!generalTrie || !r.partial)
+}
+
+// VisitAccount marks an account value before it is set as a value
+func (r *Reachable) VisitAccount(leaf *Leaf) error {
+	r.setValueClass(leaf.ValueHash, leaf.Value, AccountValueKey)
+	return nil
+}
+
+// VisitStorage does nothing, the values are storage values by default
+func (r *Reachable) VisitStorage(leaf *Leaf) error {
+	return nil
+}
+
+func (r *Reachable) setTrieNode(key, value []byte) {
+	r.lock.Lock()
+	if r.add(key, TrieNodeKey) {
+		r.stats.NbTrieNodes++
+		r.stats.TrieNodesSize += uint64(len(value))
+	}
+	r.lock.Unlock()
+}
+
+func (r *Reachable) setValue(key, value []byte) {
+	r.setValueClass(key, value, StorageValueKey)
+}
+
+func (r *Reachable) setValueClass(key, value []byte, class string) {
+	r.lock.Lock()
+	if r.add(key, class) {
+		r.stats.NbValues++
+		r.stats.ValuesSize += uint64(len(value))
+	}
+	r.lock.Unlock()
+}
+
+func (r *Reachable) setCode(key, value []byte) {
+	r.lock.Lock()
+	if r.add(key, CodeKey) {
+		r.stats.NbCodes++
+		r.stats.CodesSize += uint64(len(value))
+	}
+	r.lock.Unlock()
+}
+
+// add adds a key to the set and returns false if it was already there, the lock must be held
+func (r *Reachable) add(key []byte, class string) bool {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	if _, exists := r.keys[dbkey]; exists {
+		return false
+	}
+	r.keys[dbkey] = class
+	return true
+}
+
+func (r *Reachable) getStats() SnapshotStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stats
+}
+
+// flush does nothing, the keys are kept in memory
+func (r *Reachable) flush() error {
+	return nil
+}
+
+// Prune deletes the entries of store that are not reachable, in transactions
+// of maxPruneBatch keys. Only the keys with the length of a hash are state
+// entries, the other keys are kept.
+// With dryRun nothing is deleted and the stats report what would be deleted.
+func Prune(store db.DB, r *Reachable, dryRun bool) PruneStats {
+	var stats PruneStats
+	var toDelete [][]byte
+	deleteBatch := func() {
+		deleteKeys(store, toDelete)
+		toDelete = nil
+	}
+	for it := store.Iterator(nil, nil); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != HashLength {
+			stats.NbOther++
+			continue
+		}
+		size := uint64(len(key) + len(it.Value()))
+		if r.Contains(key) {
+			stats.NbKept++
+			stats.KeptSize += size
+			continue
+		}
+		stats.NbDeleted++
+		stats.DeletedSize += size
+		if dryRun {
+			continue
+		}
+		// the iterator reuses the key buffer
+		toDelete = append(toDelete, append([]byte{}, key...))
+		if len(toDelete) == maxPruneBatch {
+			deleteBatch()
+		}
+	}
+	if len(toDelete) != 0 {
+		deleteBatch()
+	}
+	return stats
+}
+
+// deleteKeys deletes keys from store in transactions of maxPruneBatch keys
+func deleteKeys(store db.DB, keys [][]byte) {
+	for len(keys) != 0 {
+		n := len(keys)
+		if n > maxPruneBatch {
+			n = maxPruneBatch
+		}
+		txn := store.NewTx()
+		for _, key := range keys[:n] {
+			txn.Delete(key)
+		}
+		txn.Commit()
+		keys = keys[n:]
+	}
+}
@@ -0,0 +1,91 @@
+package stool
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// TestPrune deletes the entries that are not reachable from the kept roots
+func TestPrune(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(500, 32)
+	values := storeStates(store, 500, 0)
+	code := []byte("contract code")
+	store.Set(Hasher(code), code)
+	for i := 0; i < 5; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(20, 32), storeValues(store, 20, 0))
+		storageTrie.Commit()
+		values[i] = storeContract(store, code, storageTrie.Root, 0)
+	}
+	smt.Update(keys, values)
+	smt.Commit()
+	oldRoot := smt.Root
+	smt.Update(keys[100:200], storeStates(store, 100, 1))
+	smt.Commit()
+	root := smt.Root
+	// keys that are not state entries are kept
+	store.Set([]byte("state.latest"), root)
+	// unreachable entries are deleted
+	for _, junk := range getFreshData(10, 32) {
+		store.Set(junk, []byte("junk"))
+	}
+
+	// marking both roots only leaves the junk and the 5 states replaced by contracts
+	r := NewReachable()
+	for _, kept := range [][]byte{root, oldRoot} {
+		err := NewStateAnalysis(store, false, true, false, 8).Mark(r, kept)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := Prune(store, r, true)
+	if stats.NbDeleted != 10+5 || stats.NbOther != 1 || stats.NbKept != uint64(r.Len()) {
+		t.Fatal("Expected the junk to be unreachable, got: ", stats)
+	}
+
+	// the entries of the old root are deleted
+	r = NewReachable()
+	sa := NewStateAnalysis(store, false, true, false, 8)
+	err := sa.Mark(r, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sa.visitors) != 0 || sa.reachable != nil {
+		t.Fatal("Expected Mark to leave the visitors of the analysis unchanged")
+	}
+	dryRun := Prune(store, r, true)
+	pruned := Prune(store, r, false)
+	if dryRun != pruned || pruned.NbDeleted <= 10+5+100 || pruned.NbKept != uint64(r.Len()) {
+		t.Fatal("Expected the dry run to report the deleted entries, got: ", dryRun, pruned)
+	}
+	if again := Prune(store, r, true); again.NbDeleted != 0 || again.NbKept != pruned.NbKept {
+		t.Fatal("Expected all the unreachable entries to be deleted, got: ", again)
+	}
+	if store.Get([]byte("state.latest")) == nil {
+		t.Fatal("Expected the keys that are not hashes to be kept")
+	}
+	verify := NewStateAnalysis(store, false, true, true, 8)
+	verify.CollectMissingNodes()
+	err = verify.Analyse(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verify.MissingNodes()) != 0 || verify.Counters.NbContracts != 5 {
+		t.Fatal("Expected the pruned db to contain the state of the kept root")
+	}
+	verify = NewStateAnalysis(store, false, true, true, 8)
+	verify.CollectMissingNodes()
+	err = verify.Analyse(oldRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verify.MissingNodes()) == 0 {
+		t.Fatal("Expected the state of the old root to be pruned")
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
@@ -0,0 +1,89 @@
+package stool
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+// RepairStats counts the entries fetched from the repair source and written
+// back to the state db, and the entries that couldn't be repaired
+type RepairStats struct {
+	NbTrieNodes uint64
+	NbValues    uint64
+	NbCodes     uint64
+	// NbUnrepaired is the number of entries missing from the source or whose copy doesn't match its hash
+	NbUnrepaired uint64
+}
+
+// repairSource fetches the missing or corrupted entries of a Dfs and of its
+// contract storage analyses from another state db
+type repairSource struct {
+	source db.DB
+	// lock for stats
+	lock  sync.Mutex
+	stats RepairStats
+}
+
+// SetRepairSource makes Dfs check the integrity of the state and replace the
+// missing or hash-mismatched trie nodes, values and codes by their copy in
+// source. A copy is only written back if it matches its hash, then the
+// traversal continues with the repaired entry.
+func (sa *StateAnalysis) SetRepairSource(source db.DB) {
+	sa.integrityCheck = true
+	sa.repair = &repairSource{source: source}
+}
+
+// RepairStats returns the number of entries repaired by Dfs
+func (sa *StateAnalysis) RepairStats() RepairStats {
+	if sa.repair == nil {
+		return RepairStats{}
+	}
+	sa.repair.lock.Lock()
+	defer sa.repair.lock.Unlock()
+	return sa.repair.stats
+}
+
+// repairTrieNode writes the copy of the batch of trie nodes key to the state db
+// and returns true if the copy is a batch that hashes to key
+func (sa *StateAnalysis) repairTrieNode(key []byte, height int) bool {
+	r := sa.repair
+	data := r.source.Get(key)
+	if !validBatchSize(data) || !bytes.Equal(hashBatchNode(sa.Trie.parseBatch(data), 0, height), key) {
+		r.count(&r.stats.NbUnrepaired)
+		return false
+	}
+	sa.store.Set(key, data)
+	r.count(&r.stats.NbTrieNodes)
+	return true
+}
+
+// repairEntry returns raw if it is the content of key, otherwise it writes
+// the copy of key to the state db if the copy matches its hash and returns it.
+// Values and codes are stored at the hash of their content.
+func (sa *StateAnalysis) repairEntry(key, raw []byte, code bool) []byte {
+	// nil objects are stored as empty values
+	if bytes.Equal(Hasher(raw), key) && (len(raw) != 0 || sa.Trie.dbExist(key)) {
+		return raw
+	}
+	r := sa.repair
+	data := r.source.Get(key)
+	if !bytes.Equal(Hasher(data), key) || (len(data) == 0 && !r.source.Exist(key)) {
+		r.count(&r.stats.NbUnrepaired)
+		return raw
+	}
+	sa.store.Set(key, data)
+	if code {
+		r.count(&r.stats.NbCodes)
+	} else {
+		r.count(&r.stats.NbValues)
+	}
+	return data
+}
+
+func (r *repairSource) count(counter *uint64) {
+	r.lock.Lock()
+	*counter++
+	r.lock.Unlock()
+}
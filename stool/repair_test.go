@@ -0,0 +1,91 @@
+package stool
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestRepair replaces the missing and corrupted entries by their copy in a source db
+func TestRepair(t *testing.T) {
+	store := getDb()
+	keys := getFreshData(100, 32)
+	values := storeStates(store, 100, 0)
+	var storageRoots, codes, storageValues [][]byte
+	for i := 0; i < 5; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageValues = storeValues(store, 10, 0)
+		storageTrie.Update(getFreshData(10, 32), storageValues)
+		storageTrie.Commit()
+		code := []byte(fmt.Sprintf("code %d", i))
+		store.Set(Hasher(code), code)
+		values[i] = storeContract(store, code, storageTrie.Root, 0)
+		storageRoots = append(storageRoots, storageTrie.Root)
+		codes = append(codes, code)
+	}
+	smt := trie.NewTrie(nil, Hasher, store)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	sourcePath := path.Join(".aergo", "source")
+	_ = os.MkdirAll(sourcePath, 0711)
+	source := db.NewDB(db.BadgerImpl, sourcePath)
+	copied, err := CopyEntries(store, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.NbTrieNodes == 0 || copied.NbValues < 100+5*10 {
+		t.Fatal("Expected to copy the trie nodes and values of the state, got: ", copied)
+	}
+
+	// corrupt the state: the root batch, 1 storage trie, 1 code and 1 account value
+	rootBatch := append([]byte{}, store.Get(smt.Root)...)
+	rootBatch[len(rootBatch)-2] ^= 0xff
+	store.Set(smt.Root, rootBatch)
+	store.Delete(storageRoots[0])
+	store.Delete(Hasher(codes[1]))
+	tampered, _ := proto.Marshal(&types.State{Nonce: 1})
+	store.Set(values[10], tampered)
+	// a storage value lost in both dbs cannot be repaired
+	store.Delete(storageValues[0])
+	source.Delete(storageValues[0])
+
+	sa := NewStateAnalysis(store, false, true, false, 8)
+	sa.SetRepairSource(source)
+	sa.CollectIntegrityFailures()
+	err = sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sa.RepairStats()
+	if stats.NbTrieNodes != 2 || stats.NbCodes != 1 || stats.NbValues != 1 || stats.NbUnrepaired != 1 {
+		t.Fatal("Expected 2 trie nodes, 1 code, 1 value repaired and 1 unrepaired value, got: ", stats)
+	}
+	failures := sa.MissingNodes()
+	if len(failures) != 1 || failures[0].Kind != MissingValue {
+		t.Fatal("Expected the unrepaired value to be reported, got: ", failures)
+	}
+	if sa.Counters.NbUserAccounts != 95 || sa.Counters.NbContracts != 5 {
+		t.Fatal("Expected all the accounts to be analysed, got: ", sa.Counters)
+	}
+
+	// the repaired entries were written to the state db
+	sa = NewStateAnalysis(store, false, true, false, 8)
+	sa.CollectIntegrityFailures()
+	err = sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sa.MissingNodes()) != 1 {
+		t.Fatal("Expected only the unrepaired value to fail, got: ", sa.MissingNodes())
+	}
+	source.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
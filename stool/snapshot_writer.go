@@ -0,0 +1,181 @@
+package stool
+
+import (
+	"sync"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+const (
+	// DefaultSnapshotMemory is the default size of the nodes cached before writing them to the snapshot db
+	DefaultSnapshotMemory = 256 << 20
+	// maxTxSize keeps each snapshot db transaction under the badger transaction size limit
+	maxTxSize = 4 << 20
+)
+
+// SnapshotStats counts the entries copied to a snapshot db.
+// An entry referenced several times in the state (a value shared by
+// several leaves) is counted each time it is copied.
+type SnapshotStats struct {
+	NbTrieNodes   uint64 `json:"nbTrieNodes"`
+	NbValues      uint64 `json:"nbValues"`
+	NbCodes       uint64 `json:"nbCodes"`
+	TrieNodesSize uint64 `json:"trieNodesSize"`
+	ValuesSize    uint64 `json:"valuesSize"`
+	CodesSize     uint64 `json:"codesSize"`
+}
+
+// snapshotSink receives the entries copied by a snapshot traversal
+type snapshotSink interface {
+	setTrieNode(key, value []byte)
+	setValue(key, value []byte)
+	setCode(key, value []byte)
+	getStats() SnapshotStats
+	// flush writes the remaining entries and returns the first write error
+	flush() error
+}
+
+// snapshotWriter caches snapshot nodes and flushes them to the snapshot db
+// each time the cached size reaches maxSize, so the memory used by a snapshot
+// doesn't grow with the size of the state.
+// A node cached again after being flushed is written twice, which is harmless.
+type snapshotWriter struct {
+	// lock for nodes caching and stats, the full caches are written without it
+	lock sync.Mutex
+	// database to write snapshot
+	store db.DB
+	// cache nodes before writing them to snapshot db
+	nodes map[Hash][]byte
+	// size in bytes of the cached keys and values
+	size int
+	// maxSize is the memory ceiling of the cache
+	maxSize int
+	// stats of the copied entries
+	stats SnapshotStats
+}
+
+// newSnapshotWriter creates a snapshotWriter that caches at most maxSize bytes
+func newSnapshotWriter(store db.DB, maxSize int) *snapshotWriter {
+	if maxSize <= 0 {
+		maxSize = DefaultSnapshotMemory
+	}
+	return &snapshotWriter{
+		store:   store,
+		nodes:   make(map[Hash][]byte),
+		maxSize: maxSize,
+	}
+}
+
+// setTrieNode caches a batch of trie nodes
+func (w *snapshotWriter) setTrieNode(key, value []byte) {
+	w.lock.Lock()
+	w.stats.NbTrieNodes++
+	w.stats.TrieNodesSize += uint64(len(value))
+	full := w.set(key, value)
+	w.lock.Unlock()
+	w.write(full)
+}
+
+// setValue caches an account or storage value
+func (w *snapshotWriter) setValue(key, value []byte) {
+	w.lock.Lock()
+	w.stats.NbValues++
+	w.stats.ValuesSize += uint64(len(value))
+	full := w.set(key, value)
+	w.lock.Unlock()
+	w.write(full)
+}
+
+// setCode caches a contract code
+func (w *snapshotWriter) setCode(key, value []byte) {
+	w.lock.Lock()
+	w.stats.NbCodes++
+	w.stats.CodesSize += uint64(len(value))
+	full := w.set(key, value)
+	w.lock.Unlock()
+	w.write(full)
+}
+
+// setEntry caches an entry of unknown kind copied from another snapshot db,
+// the entry is counted in the stats of the class of its content
+func (w *snapshotWriter) setEntry(key, value []byte) {
+	if len(key) != HashLength {
+		// the cache only holds hash keys
+		return
+	}
+	w.lock.Lock()
+	switch classifyEntry(key, value) {
+	case TrieNodeKey:
+		w.stats.NbTrieNodes++
+		w.stats.TrieNodesSize += uint64(len(value))
+	case AccountValueKey, StorageValueKey:
+		w.stats.NbValues++
+		w.stats.ValuesSize += uint64(len(value))
+	case CodeKey:
+		w.stats.NbCodes++
+		w.stats.CodesSize += uint64(len(value))
+	}
+	full := w.set(key, value)
+	w.lock.Unlock()
+	w.write(full)
+}
+
+// set caches a node, the lock must be held. If the cache is full, it is
+// swapped for an empty one and its nodes are returned to be written without the lock.
+func (w *snapshotWriter) set(key, value []byte) map[Hash][]byte {
+	var dbkey Hash
+	copy(dbkey[:], key)
+	if _, exists := w.nodes[dbkey]; exists {
+		return nil
+	}
+	w.nodes[dbkey] = value
+	w.size += HashLength + len(value)
+	if w.size >= w.maxSize {
+		return w.swapNodes()
+	}
+	return nil
+}
+
+// swapNodes replaces the cache by an empty one and returns the cached nodes, the lock must be held
+func (w *snapshotWriter) swapNodes() map[Hash][]byte {
+	nodes := w.nodes
+	w.nodes = make(map[Hash][]byte)
+	w.size = 0
+	return nodes
+}
+
+func (w *snapshotWriter) getStats() SnapshotStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.stats
+}
+
+// flush writes all the cached nodes to the snapshot db
+func (w *snapshotWriter) flush() error {
+	w.lock.Lock()
+	nodes := w.swapNodes()
+	w.lock.Unlock()
+	w.write(nodes)
+	return nil
+}
+
+// write commits nodes to the snapshot db in transactions of at most maxTxSize.
+// It is called without the lock so the traversal keeps caching nodes meanwhile.
+func (w *snapshotWriter) write(nodes map[Hash][]byte) {
+	if len(nodes) == 0 {
+		return
+	}
+	txn := w.store.NewTx().(DbTx)
+	txSize := 0
+	for key, value := range nodes {
+		if txSize+HashLength+len(value) > maxTxSize && txSize != 0 {
+			txn.(db.Transaction).Commit()
+			txn = w.store.NewTx().(DbTx)
+			txSize = 0
+		}
+		var node []byte
+		txn.Set(append(node, key[:]...), value)
+		txSize += HashLength + len(value)
+	}
+	txn.(db.Transaction).Commit()
+}
@@ -3,7 +3,6 @@ package stool
 import (
 	"bytes"
 	"crypto/sha256"
-	"fmt"
 	"math/big"
 	"sync"
 
@@ -29,6 +28,27 @@ var Hasher = func(data ...[]byte) []byte {
 	return hasher.Sum(nil)
 }
 
+// hashNode hashes the children of a trie node, empty children are DefaultLeaf
+func hashNode(lnode, rnode []byte) []byte {
+	return Hasher(childHash(lnode), childHash(rnode))
+}
+
+// hashShortcut hashes the key and value of a shortcut leaf tagged with the leaf height
+func hashShortcut(key, value []byte, height int) []byte {
+	return Hasher(key[:HashLength], value[:HashLength], []byte{byte(height)})
+}
+
+// childHash strips the shortcut flag byte of a node or returns DefaultLeaf if empty
+func childHash(node []byte) []byte {
+	if len(node) == 0 {
+		return DefaultLeaf
+	}
+	if len(node) > HashLength {
+		return node[:HashLength]
+	}
+	return node
+}
+
 // DbTx represents Set and Delete interface to store data
 type DbTx interface {
 	Set(key, value []byte)
@@ -45,20 +65,24 @@ type StateAnalysis struct {
 	Trie *TrieReader
 	// if true copies a snapshot of nodes to a snapshot db
 	snapshot bool
-	// max Threads created while parsing trie
-	maxThread uint
-	// current total nb of threads created
-	totalThread uint
-	// cache shortcut nodes before writing them to snapshot db
-	snapshotNodes map[Hash][]byte
-	// snapshotLock for snapshot nodes caching
-	snapshotLock sync.RWMutex
-	// snapStoreLock for snapshotNodes writing to snapStore
-	snapStoreLock sync.RWMutex
+	// number of goroutines traversing the trie
+	workers uint
+	// pool of workers shared with contract storage analyses
+	pool *workerPool
+	// traversal of the current Dfs
+	traversal *traversal
+	// snapWriter writes snapshot nodes to snapStore in size-limited batches or to an archive
+	snapWriter snapshotSink
+	// snapshotMemory is the memory ceiling of snapshot nodes waiting to be written
+	snapshotMemory int
 	// differenciate a general trie analysis from a storage trie analysis
 	generalTrie bool
 	// database to read from
 	store db.DB
+	// layers are read in order after store when an entry is missing from store
+	layers []db.DB
+	// layerReads counts the reads served by store and each layer, shared with contract storage analyses
+	layerReads []uint64
 	// database to write snapshot
 	snapStore db.DB
 	// countDbReads
@@ -68,6 +92,19 @@ type StateAnalysis struct {
 	// set accountKey to snapshot a specific account (voting contract)
 	// and the key path nodes in general trie.
 	accountKey []byte
+	// visitors are called for each account and storage leaf
+	visitors []LeafVisitor
+	// account is the trie key of the contract of a storage trie analysis
+	account []byte
+	// keyRange restricts the general trie traversal to a range of account keys
+	keyRange *KeyRange
+	// missing records the missing nodes, and the corrupted nodes when collecting
+	// integrity failures, instead of failing when not nil
+	missing *missingNodes
+	// reachable skips the subtrees already marked when marking reachable entries
+	reachable *Reachable
+	// repair fetches the missing or corrupted entries from another db when not nil
+	repair *repairSource
 }
 
 // Counters groups counters together
@@ -97,7 +134,7 @@ type Counters struct {
 }
 
 // NewStateAnalysis initialises StateAnalysis
-func NewStateAnalysis(store db.DB, countDbReads, generalTrie, integrityCheck bool, maxThread uint) *StateAnalysis {
+func NewStateAnalysis(store db.DB, countDbReads, generalTrie, integrityCheck bool, workers uint) *StateAnalysis {
 	c := &Counters{
 		NbUserAccounts:  0,
 		NbUserAccounts0: 0,
@@ -106,15 +143,14 @@ func NewStateAnalysis(store db.DB, countDbReads, generalTrie, integrityCheck boo
 		NbStorageValues: 0,
 		CumulatedHeight: 0,
 		AverageDepth:    0,
-		DeepestLeaf:     256,
+		DeepestLeaf:     0,
 		TotalAerBalance: new(big.Int).SetUint64(0),
 	}
 	return &StateAnalysis{
 		Counters:       c,
-		maxThread:      maxThread,
-		totalThread:    0,
-		snapshotNodes:  make(map[Hash][]byte),
+		workers:        workers,
 		snapshot:       false,
+		snapshotMemory: DefaultSnapshotMemory,
 		generalTrie:    generalTrie,
 		store:          store,
 		countDbReads:   countDbReads,
@@ -122,47 +158,146 @@ func NewStateAnalysis(store db.DB, countDbReads, generalTrie, integrityCheck boo
 	}
 }
 
+// AddVisitors registers visitors called for each leaf during Dfs.
+// Contract storage tries are also traversed when visitors are registered.
+func (sa *StateAnalysis) AddVisitors(visitors ...LeafVisitor) {
+	sa.visitors = append(sa.visitors, visitors...)
+}
+
+// AddLayers makes Dfs read the entries missing from the store of the analysis
+// in stores, in order. The store can be a delta snapshot over its base snapshot
+// or a hot db over a cold archive, they are analysed without being merged.
+func (sa *StateAnalysis) AddLayers(stores ...db.DB) {
+	if len(stores) == 0 {
+		return
+	}
+	sa.layers = append(sa.layers, stores...)
+	sa.layerReads = make([]uint64, 1+len(sa.layers))
+}
+
+// LayerReads returns the number of reads served by the store of the analysis
+// and by each layer, or nil without layers
+func (sa *StateAnalysis) LayerReads() []uint64 {
+	return loadCounters(sa.layerReads)
+}
+
+// newTrieReader creates a TrieReader of the store and layers of the analysis
+func (sa *StateAnalysis) newTrieReader(countDbReads bool) *TrieReader {
+	tr := NewLayeredTrieReader(append([]db.DB{sa.store}, sa.layers...), countDbReads)
+	if sa.layerReads != nil {
+		tr.layerReads = sa.layerReads
+	}
+	return tr
+}
+
+// SetKeyRange restricts Analyse and Snapshot to the accounts in keyRange.
+// Subtrees outside the range are not traversed.
+func (sa *StateAnalysis) SetKeyRange(keyRange *KeyRange) {
+	sa.keyRange = keyRange
+}
+
+// SetSnapshotMemory sets the size in bytes of the nodes cached by Snapshot
+// before they are written to the snapshot db.
+func (sa *StateAnalysis) SetSnapshotMemory(size int) {
+	sa.snapshotMemory = size
+}
+
+// SnapshotStats returns the number and size of the entries copied by the last snapshot
+func (sa *StateAnalysis) SnapshotStats() SnapshotStats {
+	if sa.snapWriter == nil {
+		return SnapshotStats{}
+	}
+	return sa.snapWriter.getStats()
+}
+
 // Snapshot uses Dfs to copy nodes to a new snapshot db
 func (sa *StateAnalysis) Snapshot(snapStore db.DB, root []byte) error {
 	sa.snapStore = snapStore
-	sa.snapshot = true
 	sa.accountKey = nil
-	err := sa.Dfs(root)
-	if err != nil {
-		return err
-	}
-	sa.commitSnapshotNodes(sa.snapshotNodes)
-	sa.commitSnapshotNodes(sa.Trie.snapshotNodes)
-	return nil
+	return sa.snapshotDfs(newSnapshotWriter(snapStore, sa.snapshotMemory), root)
+}
+
+// SnapshotArchive uses Dfs to stream nodes to an archive
+func (sa *StateAnalysis) SnapshotArchive(archive *ArchiveWriter, root []byte) error {
+	sa.accountKey = nil
+	return sa.snapshotDfs(archive, root)
 }
 
 // Analyse uses Dfs to analyse and count trie nodes
 func (sa *StateAnalysis) Analyse(root []byte) error {
 	sa.snapshot = false
+	sa.accountKey = nil
+	return sa.Dfs(root)
+}
+
+// AnalyseAccount uses Dfs to analyse the key path and state of a single account
+func (sa *StateAnalysis) AnalyseAccount(root, trieKey []byte) error {
+	sa.snapshot = false
+	sa.accountKey = trieKey
 	return sa.Dfs(root)
 }
 
 // SnapshotAccount uses Dfs to copy account state nodes and key path to a new snapshot db
 func (sa *StateAnalysis) SnapshotAccount(snapStore db.DB, root, trieKey []byte) error {
 	sa.snapStore = snapStore
-	sa.snapshot = true
 	sa.accountKey = trieKey
+	return sa.snapshotDfs(newSnapshotWriter(snapStore, sa.snapshotMemory), root)
+}
+
+// SnapshotAccountArchive uses Dfs to stream account state nodes and key path to an archive
+func (sa *StateAnalysis) SnapshotAccountArchive(archive *ArchiveWriter, root, trieKey []byte) error {
+	sa.accountKey = trieKey
+	return sa.snapshotDfs(archive, root)
+}
+
+// snapshotDfs runs Dfs with a snapshot sink and writes the remaining cached nodes
+func (sa *StateAnalysis) snapshotDfs(sink snapshotSink, root []byte) error {
+	sa.snapshot = true
+	sa.snapWriter = sink
 	err := sa.Dfs(root)
 	if err != nil {
 		return err
 	}
-	sa.commitSnapshotNodes(sa.snapshotNodes)
-	sa.commitSnapshotNodes(sa.Trie.snapshotNodes)
-	return nil
+	return sa.snapWriter.flush()
 }
 
 // Dfs Depth first search all the trie leaves starting from root
 // For each leaf count it and add it's balance to the total
+// Subtrees are queued to a pool of workers while the calling goroutine
+// walks the trie and then helps the pool until all subtrees are done.
 func (sa *StateAnalysis) Dfs(root []byte) error {
-	sa.Trie = NewTrieReader(sa.store, sa.countDbReads, sa.snapshot)
-	ch := make(chan error, 1)
-	sa.dfs(root, 0, 256, nil, ch)
-	err := <-ch
+	sa.Trie = sa.newTrieReader(sa.countDbReads)
+	if sa.snapshot {
+		sa.Trie.snapWriter = sa.snapWriter
+	}
+	// the batches on the boundary of a key range are only partially traversed,
+	// a repaired batch replaces the whole corrupted batch
+	sa.Trie.checkBatches = sa.integrityCheck && (sa.keyRange != nil || sa.repair != nil)
+	// a corrupted batch cannot be parsed
+	sa.Trie.checkSizes = sa.collectsCorruption()
+	if sa.pool == nil {
+		sa.pool = newWorkerPool(sa.workers)
+		defer func() {
+			sa.pool.stop()
+			sa.pool = nil
+		}()
+	}
+	sa.traversal = &traversal{}
+	// DeepestLeaf is the smallest leaf height during the traversal so that
+	// the counters of several Dfs (key ranges) can be accumulated
+	sa.Counters.DeepestLeaf = 256 - sa.Counters.DeepestLeaf
+	// the path is tracked for the key range, the failures and the errors
+	err := sa.dfs(root, make([]byte, HashLength), 0, 256, nil)
+	if err != nil {
+		sa.traversal.setErr(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		sa.traversal.pending.Wait()
+		close(done)
+	}()
+	sa.pool.helpUntil(done)
+	err = sa.traversal.getErr()
 	sa.Counters.DeepestLeaf = 256 - sa.Counters.DeepestLeaf
 	if sa.generalTrie {
 		totalLeaves := float64(sa.Counters.NbUserAccounts + sa.Counters.NbUserAccounts0 + sa.Counters.NbContracts + sa.Counters.NbNilObjects)
@@ -173,30 +308,51 @@ func (sa *StateAnalysis) Dfs(root []byte) error {
 	return err
 }
 
-func (sa *StateAnalysis) dfs(root []byte, iBatch, height int, batch [][]byte, ch chan<- (error)) {
+func (sa *StateAnalysis) dfs(root, path []byte, iBatch, height int, batch [][]byte) error {
+	if sa.traversal.getErr() != nil {
+		// another subtree failed, stop the traversal
+		return nil
+	}
+	if sa.keyRange != nil && !sa.keyRange.overlaps(path, 256-height) {
+		// prune subtree outside of the key range
+		return nil
+	}
+	if sa.reachable != nil && height%4 == 0 && sa.reachable.marked(root[:HashLength], sa.generalTrie) {
+		// the subtree was marked from another root
+		return nil
+	}
 	batch, iBatch, lnode, rnode, isShortcut, err := sa.Trie.LoadChildren(root, height, iBatch, batch)
+	if err != nil && height%4 == 0 && sa.repair != nil && sa.repairTrieNode(root[:HashLength], height) {
+		batch, iBatch, lnode, rnode, isShortcut, err = sa.Trie.LoadChildren(root, height, iBatch, batch)
+	}
 	if err != nil {
-		ch <- err
-		return
+		// skip the missing or corrupted batch and continue the traversal
+		skip := false
+		switch e := err.(type) {
+		case *ErrMissingNode:
+			skip = sa.record(root[:HashLength], nil, path, height, MissingTrieNode)
+		case *ErrUndecodableNode:
+			skip = sa.record(root[:HashLength], nil, path, height, UndecodableNode)
+		case *ErrHashMismatch:
+			// the batch doesn't match its hash (key range)
+			skip = sa.record(root[:HashLength], e.Got, path, height, HashMismatch)
+		}
+		if skip {
+			return nil
+		}
+		setErrPath(err, pathBits(path, 256-height))
+		return err
 	}
 	if isShortcut {
-		ch <- sa.processShortcut(root, lnode, rnode, height)
-		return
+		return sa.processShortcut(root, path, lnode, rnode, height)
 	} else if sa.integrityCheck {
 		// if not leaf node and check integrity, then hash nodes to perform check
-		var h []byte
 		// lnode and rnode cannot be default at the same time
-		if len(lnode) == 0 {
-			h = Hasher(DefaultLeaf, rnode[:HashLength])
-		} else if len(rnode) == 0 {
-			h = Hasher(lnode[:HashLength], DefaultLeaf)
-		} else {
-			h = Hasher(lnode[:HashLength], rnode[:HashLength])
-		}
-		if !bytes.Equal(root[:HashLength], h) {
-			fmt.Println(root, lnode, rnode)
-			ch <- fmt.Errorf("Warning: state integrity failed")
-			return
+		if h := hashNode(lnode, rnode); !bytes.Equal(root[:HashLength], h) {
+			if sa.record(root[:HashLength], h, path, height, HashMismatch) {
+				return nil
+			}
+			return &ErrHashMismatch{Expected: root[:HashLength], Got: h, Height: height}
 		}
 	}
 	// step to next node
@@ -204,68 +360,110 @@ func (sa *StateAnalysis) dfs(root []byte, iBatch, height int, batch [][]byte, ch
 		// snapshot single account path in general trie
 		if bitIsSet(sa.accountKey, 256-height) {
 			if rnode == nil {
-				ch <- fmt.Errorf("nil node in the path: account not in general trie")
-				return
-			}
-			err := sa.stepRight(rnode, iBatch, height, batch)
-			ch <- err
-		} else {
-			if lnode == nil {
-				ch <- fmt.Errorf("nil node in the path: account not in general trie")
-				return
+				return &ErrAccountNotFound{Key: sa.accountKey}
 			}
-			err := sa.stepLeft(lnode, iBatch, height, batch)
-			ch <- err
+			return sa.stepRight(rnode, path, iBatch, height, batch)
 		}
-	} else {
-		err = sa.stepRightLeft(lnode, rnode, iBatch, height, batch)
-		ch <- err
+		if lnode == nil {
+			return &ErrAccountNotFound{Key: sa.accountKey}
+		}
+		return sa.stepLeft(lnode, path, iBatch, height, batch)
 	}
+	return sa.stepRightLeft(lnode, rnode, path, iBatch, height, batch)
 }
 
-func (sa *StateAnalysis) processShortcut(root, lnode, rnode []byte, height int) error {
+func (sa *StateAnalysis) processShortcut(root, path, lnode, rnode []byte, height int) error {
 	if sa.integrityCheck {
-		if !bytes.Equal(root[:HashLength], Hasher(lnode[:HashLength], rnode[:HashLength], []byte{byte(height)})) {
-			return fmt.Errorf("Warning: state integrity failed")
+		if h := hashShortcut(lnode, rnode, height); !bytes.Equal(root[:HashLength], h) {
+			if sa.record(root[:HashLength], h, path, height, BadShortcut) {
+				return nil
+			}
+			return &ErrHashMismatch{Expected: root[:HashLength], Got: h, Height: height}
 		}
 	}
+	if sa.collectsCorruption() && !hasPrefix(lnode[:HashLength], path, 256-height) {
+		// the key of the leaf is not on the path of the shortcut
+		sa.record(root[:HashLength], nil, path, height, BadShortcut)
+		return nil
+	}
+	if sa.keyRange != nil && !sa.keyRange.Contains(lnode[:HashLength]) {
+		// the leaf is in a subtree overlapping the range but its key is outside
+		return nil
+	}
+	if sa.generalTrie && sa.accountKey != nil && !bytes.Equal(sa.accountKey, lnode[:HashLength]) {
+		// the path of a single account (aergo.system) leads to another account
+		return &ErrAccountNotFound{Key: sa.accountKey}
+	}
 	sa.counterLock.Lock()
 	sa.Counters.CumulatedHeight += height
 	if sa.Counters.DeepestLeaf > height {
 		sa.Counters.DeepestLeaf = height
 	}
 	sa.counterLock.Unlock()
-	raw := sa.Trie.db.Get(rnode[:HashLength])
+	raw := sa.Trie.dbGet(rnode[:HashLength])
+	if sa.repair != nil {
+		raw = sa.repairEntry(rnode[:HashLength], raw, false)
+	}
+	if len(raw) == 0 && sa.missing != nil && !sa.Trie.dbExist(rnode[:HashLength]) {
+		// nil objects are stored as empty values
+		sa.record(rnode[:HashLength], nil, path, height, MissingValue)
+		return nil
+	}
+	if sa.collectsCorruption() && len(raw) != 0 {
+		if h := Hasher(raw); !bytes.Equal(h, rnode[:HashLength]) {
+			sa.record(rnode[:HashLength], h, path, height, HashMismatch)
+			return nil
+		}
+	}
 	if sa.generalTrie {
 		// always parse account in general trie
 		storageRoot, codeHash, err := sa.parseAccount(raw)
 		if err != nil {
+			if sa.record(rnode[:HashLength], nil, path, height, UndecodableAccount) {
+				return nil
+			}
 			return err
 		}
+		for _, v := range sa.visitors {
+			err := v.VisitAccount(&Leaf{
+				TrieKey:   lnode[:HashLength],
+				ValueHash: rnode[:HashLength],
+				Value:     raw,
+				Height:    height,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if codeHash != nil && (sa.missing != nil || sa.repair != nil) {
+			code := sa.Trie.dbGet(codeHash)
+			if sa.repair != nil {
+				code = sa.repairEntry(codeHash, code, true)
+			}
+			if len(code) == 0 {
+				sa.record(codeHash, nil, path, height, MissingCode)
+			} else if sa.collectsCorruption() {
+				if h := Hasher(code); !bytes.Equal(h, codeHash) {
+					sa.record(codeHash, h, path, height, HashMismatch)
+				}
+			}
+		}
 		if sa.snapshot {
 			// snapshot always requires copying contract state
-			if sa.accountKey != nil && !bytes.Equal(sa.accountKey, lnode[:HashLength]) {
-				// if snapshot of a single account (aergo.system) then it should match leaf
-				return fmt.Errorf("lnode doesnt match requested account key snapshot")
-			}
 			if storageRoot != nil {
 				// snapshot contract storage nodes
-				err := sa.snapshotContractState(storageRoot)
+				err := sa.snapshotContractState(storageRoot, lnode[:HashLength])
 				if err != nil {
 					return err
 				}
 			}
 			if codeHash != nil {
-				code := sa.Trie.db.Get(codeHash)
-				var dbkey Hash
-				copy(dbkey[:], codeHash)
-				sa.snapshotLock.Lock()
-				sa.snapshotNodes[dbkey] = code
-				sa.snapshotLock.Unlock()
+				code := sa.Trie.dbGet(codeHash)
+				sa.snapWriter.setCode(codeHash, code)
 			}
-		} else if sa.integrityCheck && storageRoot != nil {
-			// contracts only need to be analysed when doing integrity check
-			err := sa.analyseContractState(storageRoot)
+		} else if (sa.integrityCheck || len(sa.visitors) != 0) && storageRoot != nil {
+			// contracts only need to be analysed when doing integrity check or visiting storage
+			err := sa.analyseContractState(storageRoot, lnode[:HashLength])
 			if err != nil {
 				return err
 			}
@@ -277,72 +475,74 @@ func (sa *StateAnalysis) processShortcut(root, lnode, rnode []byte, height int)
 		sa.counterLock.Lock()
 		sa.Counters.NbStorageValues++
 		sa.counterLock.Unlock()
+		for _, v := range sa.visitors {
+			err := v.VisitStorage(&Leaf{
+				TrieKey:   lnode[:HashLength],
+				ValueHash: rnode[:HashLength],
+				Value:     raw,
+				Height:    height,
+				Account:   sa.account,
+			})
+			if err != nil {
+				return err
+			}
+		}
 	}
 	if sa.snapshot {
 		// snapshot shortcut node
-		var dbkey Hash
-		copy(dbkey[:], rnode[:HashLength])
-		sa.snapshotLock.Lock()
-		sa.snapshotNodes[dbkey] = raw
-		sa.snapshotLock.Unlock()
+		sa.snapWriter.setValue(rnode[:HashLength], raw)
 	}
 	return nil
 }
 
-func (sa *StateAnalysis) stepRightLeft(lnode, rnode []byte, iBatch, height int, batch [][]byte) error {
+func (sa *StateAnalysis) stepRightLeft(lnode, rnode, path []byte, iBatch, height int, batch [][]byte) error {
 	if lnode != nil && rnode != nil {
-		lch := make(chan error, 1)
-		rch := make(chan error, 1)
-		if sa.totalThread < sa.maxThread {
-			go sa.dfs(lnode, 2*iBatch+1, height-1, batch, lch)
-			go sa.dfs(rnode, 2*iBatch+2, height-1, batch, rch)
-			sa.counterLock.Lock()
-			sa.totalThread += 2
-			sa.counterLock.Unlock()
-		} else {
-			sa.dfs(lnode, 2*iBatch+1, height-1, batch, lch)
-			sa.dfs(rnode, 2*iBatch+2, height-1, batch, rch)
-		}
-		lresult := <-lch
-		if lresult != nil {
-			return lresult
+		// queue the right subtree if a worker is available, otherwise walk it inline
+		rpath := sa.stepPath(path, height, true)
+		t := sa.traversal
+		t.pending.Add(1)
+		queued := sa.pool.trySubmit(func() {
+			defer t.pending.Done()
+			err := sa.dfs(rnode, rpath, 2*iBatch+2, height-1, batch)
+			if err != nil {
+				t.setErr(err)
+			}
+		})
+		if !queued {
+			t.pending.Done()
 		}
-		rresult := <-rch
-		if rresult != nil {
-			return rresult
+		err := sa.stepLeft(lnode, path, iBatch, height, batch)
+		if err != nil || queued {
+			return err
 		}
+		return sa.stepRight(rnode, path, iBatch, height, batch)
 	} else if lnode != nil {
-		return sa.stepLeft(lnode, iBatch, height, batch)
+		return sa.stepLeft(lnode, path, iBatch, height, batch)
 	} else if rnode != nil {
-		return sa.stepRight(rnode, iBatch, height, batch)
+		return sa.stepRight(rnode, path, iBatch, height, batch)
 	}
 	return nil
 }
 
-func (sa *StateAnalysis) stepRight(rnode []byte, iBatch, height int, batch [][]byte) error {
-	rch := make(chan error, 1)
+func (sa *StateAnalysis) stepRight(rnode, path []byte, iBatch, height int, batch [][]byte) error {
 	if rnode != nil {
-		sa.dfs(rnode, 2*iBatch+2, height-1, batch, rch)
-		rresult := <-rch
-		if rresult != nil {
-			return rresult
-		}
+		return sa.dfs(rnode, sa.stepPath(path, height, true), 2*iBatch+2, height-1, batch)
 	}
 	return nil
 }
 
-func (sa *StateAnalysis) stepLeft(lnode []byte, iBatch, height int, batch [][]byte) error {
-	lch := make(chan error, 1)
+func (sa *StateAnalysis) stepLeft(lnode, path []byte, iBatch, height int, batch [][]byte) error {
 	if lnode != nil {
-		sa.dfs(lnode, 2*iBatch+1, height-1, batch, lch)
-		lresult := <-lch
-		if lresult != nil {
-			return lresult
-		}
+		return sa.dfs(lnode, sa.stepPath(path, height, false), 2*iBatch+1, height-1, batch)
 	}
 	return nil
 }
 
+// stepPath returns the key path of a child node
+func (sa *StateAnalysis) stepPath(path []byte, height int, right bool) []byte {
+	return childPath(path, 256-height, right)
+}
+
 func (sa *StateAnalysis) parseAccount(raw []byte) ([]byte, []byte, error) {
 	if len(raw) == 0 {
 		// transaction with amount 0 to a new address creates a balance 0 and nonce 0 account
@@ -373,23 +573,32 @@ func (sa *StateAnalysis) parseAccount(raw []byte) ([]byte, []byte, error) {
 	return storageRoot, codeHash, nil
 }
 
-func (sa *StateAnalysis) snapshotContractState(storageRoot []byte) error {
+func (sa *StateAnalysis) snapshotContractState(storageRoot, account []byte) error {
 	// TODO count db reads of contracts
-	storageAnalysis := NewStateAnalysis(sa.store, false, false, false, 1000)
+	storageAnalysis := NewStateAnalysis(sa.store, false, false, sa.integrityCheck, sa.workers)
+	storageAnalysis.pool = sa.pool
+	storageAnalysis.visitors = sa.visitors
+	storageAnalysis.account = account
 	storageAnalysis.snapStore = sa.snapStore
+	storageAnalysis.layers = sa.layers
+	storageAnalysis.layerReads = sa.layerReads
+	storageAnalysis.reachable = sa.reachable
 	storageAnalysis.snapshot = true
-	err := storageAnalysis.Dfs(storageRoot)
-	if err != nil {
-		return err
-	}
-	sa.commitSnapshotNodes(storageAnalysis.snapshotNodes)
-	sa.commitSnapshotNodes(storageAnalysis.Trie.snapshotNodes)
-	return nil
+	// share the writer so that the memory ceiling applies to the whole snapshot
+	storageAnalysis.snapWriter = sa.snapWriter
+	return storageAnalysis.Dfs(storageRoot)
 }
 
-func (sa *StateAnalysis) analyseContractState(storageRoot []byte) error {
+func (sa *StateAnalysis) analyseContractState(storageRoot, account []byte) error {
 	// TODO count db reads of contracts
-	storageAnalysis := NewStateAnalysis(sa.store, false, false, sa.integrityCheck, 1000)
+	storageAnalysis := NewStateAnalysis(sa.store, false, false, sa.integrityCheck, sa.workers)
+	storageAnalysis.pool = sa.pool
+	storageAnalysis.missing = sa.missing
+	storageAnalysis.layers = sa.layers
+	storageAnalysis.layerReads = sa.layerReads
+	storageAnalysis.repair = sa.repair
+	storageAnalysis.visitors = sa.visitors
+	storageAnalysis.account = account
 	storageAnalysis.snapshot = false
 	err := storageAnalysis.Dfs(storageRoot)
 	if err != nil {
@@ -397,14 +606,3 @@ func (sa *StateAnalysis) analyseContractState(storageRoot []byte) error {
 	}
 	return nil
 }
-
-func (sa *StateAnalysis) commitSnapshotNodes(snapshotNodes map[Hash][]byte) {
-	sa.snapStoreLock.Lock()
-	txn := sa.snapStore.NewTx().(DbTx)
-	for key, value := range snapshotNodes {
-		var node []byte
-		txn.Set(append(node, key[:]...), value)
-	}
-	txn.(db.Transaction).Commit()
-	sa.snapStoreLock.Unlock()
-}
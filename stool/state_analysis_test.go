@@ -2,6 +2,7 @@ package stool
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -122,6 +124,514 @@ func TestAccountsAnalysisFullLoad(t *testing.T) {
 	os.RemoveAll(".aergo")
 }
 
+// countVisitor counts visited leaves
+type countVisitor struct {
+	lock     sync.Mutex
+	accounts int
+	storage  map[Hash]int
+}
+
+func (v *countVisitor) VisitAccount(leaf *Leaf) error {
+	v.lock.Lock()
+	v.accounts++
+	v.lock.Unlock()
+	return nil
+}
+
+func (v *countVisitor) VisitStorage(leaf *Leaf) error {
+	var account Hash
+	copy(account[:], leaf.Account)
+	v.lock.Lock()
+	v.storage[account]++
+	v.lock.Unlock()
+	return nil
+}
+
+// TestLeafVisitor visits account and contract storage leaves
+func TestLeafVisitor(t *testing.T) {
+	store := getDb()
+	// contract storage trie with 10 values
+	storageTrie := trie.NewTrie(nil, Hasher, store)
+	storageKeys := getFreshData(10, 32)
+	storageValues := getFreshData(10, 32)
+	storageTrie.Update(storageKeys, storageValues)
+	storageTrie.Commit()
+	txn := store.NewTx()
+	for _, v := range storageValues {
+		(txn).Set(v, []byte("storage value"))
+	}
+	contract, _ := proto.Marshal(&types.State{CodeHash: []byte("code hash"), StorageRoot: storageTrie.Root})
+	user, _ := proto.Marshal(&types.State{Balance: []byte{1}})
+	(txn).Set(Hasher(contract), contract)
+	(txn).Set(Hasher(user), user)
+	txn.(db.Transaction).Commit()
+
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(2, 32)
+	smt.Update(keys, [][]byte{Hasher(contract), Hasher(user)})
+	smt.Commit()
+
+	v1 := &countVisitor{storage: make(map[Hash]int)}
+	v2 := &countVisitor{storage: make(map[Hash]int)}
+	sa := NewStateAnalysis(store, false, true, false, 10000)
+	sa.AddVisitors(v1, v2)
+	err := sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*countVisitor{v1, v2} {
+		if v.accounts != 2 {
+			t.Fatal("Expected to visit 2 accounts, got: ", v.accounts)
+		}
+		var contractKey Hash
+		copy(contractKey[:], keys[0])
+		if len(v.storage) != 1 || v.storage[contractKey] != 10 {
+			t.Fatal("Expected to visit 10 storage values of the contract, got: ", v.storage)
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestWorkers analyses contracts with storage tries with different pool sizes
+func TestWorkers(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	txn := store.NewTx()
+	var keys, values [][]byte
+	for _, key := range getFreshData(50, 32) {
+		// each contract has its own storage trie sharing the pool of workers
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(20, 32), getFreshData(20, 32))
+		storageTrie.Commit()
+		contract, _ := proto.Marshal(&types.State{CodeHash: []byte("code hash"), StorageRoot: storageTrie.Root})
+		(txn).Set(Hasher(contract), contract)
+		keys = append(keys, key)
+		values = append(values, Hasher(contract))
+	}
+	txn.(db.Transaction).Commit()
+	smt.Update(keys, values)
+	smt.Commit()
+
+	for _, workers := range []uint{1, 2, 64} {
+		v := &countVisitor{storage: make(map[Hash]int)}
+		sa := NewStateAnalysis(store, false, true, true, workers)
+		sa.AddVisitors(v)
+		err := sa.Analyse(smt.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sa.Counters.NbContracts != 50 || len(v.storage) != 50 {
+			t.Fatal("Expected to analyse 50 contracts with ", workers, " workers, got: ", sa.Counters.NbContracts)
+		}
+		for _, n := range v.storage {
+			if n != 20 {
+				t.Fatal("Expected to visit 20 storage values per contract, got: ", n)
+			}
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestKeyRangeAnalysis analyses shards of the trie by key range and prefix
+func TestKeyRangeAnalysis(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	user, _ := proto.Marshal(&types.State{Balance: []byte{1}})
+	store.Set(Hasher(user), user)
+	keys := getFreshData(1000, 32)
+	values := make([][]byte, len(keys))
+	for i := range values {
+		values[i] = Hasher(user)
+	}
+	smt.Update(keys, values)
+	smt.Commit()
+
+	sa := NewStateAnalysis(store, false, true, true, 10000)
+	sa.SetKeyRange(&KeyRange{Start: keys[100], End: keys[200]})
+	err := sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Counters.NbUserAccounts != 100 {
+		t.Fatal("Expected to find 100 accounts in the key range, got: ", sa.Counters.NbUserAccounts)
+	}
+	// shards of 2 bit prefixes cover the whole trie
+	var total uint
+	for _, prefix := range []string{"00", "01", "10", "11"} {
+		keyRange, err := PrefixRange(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sa := NewStateAnalysis(store, true, true, true, 10000)
+		sa.SetKeyRange(keyRange)
+		err = sa.Analyse(smt.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += sa.Counters.NbUserAccounts
+	}
+	if total != 1000 {
+		t.Fatal("Expected to find 1000 accounts in all prefix shards, got: ", total)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestSnapshotMemory snapshots a state with a small memory ceiling so that
+// nodes are written to the snapshot db in many batches
+func TestSnapshotMemory(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	txn := store.NewTx()
+	var keys, values [][]byte
+	for _, key := range getFreshData(20, 32) {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageValues := getFreshData(50, 32)
+		storageTrie.Update(getFreshData(50, 32), storageValues)
+		storageTrie.Commit()
+		for _, v := range storageValues {
+			(txn).Set(v, []byte("storage value"))
+		}
+		contract, _ := proto.Marshal(&types.State{CodeHash: Hasher(key), StorageRoot: storageTrie.Root})
+		(txn).Set(Hasher(key), []byte("code"))
+		(txn).Set(Hasher(contract), contract)
+		keys = append(keys, key)
+		values = append(values, Hasher(contract))
+	}
+	txn.(db.Transaction).Commit()
+	smt.Update(keys, values)
+	smt.Commit()
+
+	snapPath := path.Join(".aergo", "snapshot")
+	_ = os.MkdirAll(snapPath, 0711)
+	snapStore := db.NewDB(db.BadgerImpl, snapPath)
+	sa := NewStateAnalysis(store, false, true, true, 8)
+	sa.SetSnapshotMemory(4096)
+	err := sa.Snapshot(snapStore, smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sa.SnapshotStats()
+	if stats.NbCodes != 20 || stats.NbValues != 20+20*50 || stats.NbTrieNodes == 0 {
+		t.Fatal("Expected to copy 20 codes and 1020 values, got: ", stats)
+	}
+
+	// the snapshot contains the whole state
+	v := &countVisitor{storage: make(map[Hash]int)}
+	snapAnalysis := NewStateAnalysis(snapStore, false, true, true, 8)
+	snapAnalysis.AddVisitors(v)
+	err = snapAnalysis.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapAnalysis.Counters.NbContracts != 20 || len(v.storage) != 20 {
+		t.Fatal("Expected to find 20 contracts in the snapshot, got: ", snapAnalysis.Counters.NbContracts)
+	}
+	for _, n := range v.storage {
+		if n != 50 {
+			t.Fatal("Expected to find 50 storage values per contract in the snapshot, got: ", n)
+		}
+	}
+	for _, key := range keys {
+		if !bytes.Equal(snapStore.Get(Hasher(key)), []byte("code")) {
+			t.Fatal("Expected contract code in the snapshot")
+		}
+	}
+	snapStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestCollectMissingNodes records all the missing nodes of a corrupted state
+func TestCollectMissingNodes(t *testing.T) {
+	store := getDb()
+	txn := store.NewTx()
+	var keys, values, storageRoots [][]byte
+	for i, key := range getFreshData(10, 32) {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageValues := getFreshData(10, 32)
+		storageTrie.Update(getFreshData(10, 32), storageValues)
+		storageTrie.Commit()
+		for _, v := range storageValues {
+			(txn).Set(v, []byte("storage value"))
+		}
+		code := []byte(fmt.Sprintf("code %d", i))
+		(txn).Set(Hasher(code), code)
+		contract, _ := proto.Marshal(&types.State{CodeHash: Hasher(code), StorageRoot: storageTrie.Root})
+		(txn).Set(Hasher(contract), contract)
+		keys = append(keys, key)
+		values = append(values, Hasher(contract))
+		storageRoots = append(storageRoots, storageTrie.Root)
+	}
+	user, _ := proto.Marshal(&types.State{Balance: []byte{1}})
+	(txn).Set(Hasher(user), user)
+	txn.(db.Transaction).Commit()
+	userKeys := getFreshData(100, 32)
+	userValues := make([][]byte, len(userKeys))
+	for i := range userValues {
+		userValues[i] = Hasher(user)
+	}
+	smt := trie.NewTrie(nil, Hasher, store)
+	smt.Update(userKeys, userValues)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	// corrupt the state: 2 storage tries, 1 contract code and the user account value
+	store.Delete(storageRoots[0])
+	store.Delete(storageRoots[1])
+	store.Delete(Hasher([]byte("code 2")))
+	store.Delete(Hasher(user))
+
+	sa := NewStateAnalysis(store, false, true, true, 8)
+	err := sa.Analyse(smt.Root)
+	if err == nil {
+		t.Fatal("Expected the analysis to fail on the first missing node")
+	}
+	sa = NewStateAnalysis(store, false, true, true, 8)
+	sa.CollectMissingNodes()
+	err = sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	for _, m := range sa.MissingNodes() {
+		kinds[m.Kind]++
+	}
+	if kinds[MissingTrieNode] != 2 || kinds[MissingCode] != 1 || kinds[MissingValue] != 100 {
+		t.Fatal("Expected 2 missing trie nodes, 1 missing code and 100 missing values, got: ", kinds)
+	}
+	if sa.Counters.NbContracts != 10 {
+		t.Fatal("Expected to analyse 10 contracts, got: ", sa.Counters.NbContracts)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestCollectIntegrityFailures records all the integrity failures of a corrupted state
+func TestCollectIntegrityFailures(t *testing.T) {
+	store := getDb()
+	keys := getFreshData(110, 32)
+	values := storeStates(store, 100, 0)
+	var storageRoots, codes [][]byte
+	for i := 0; i < 10; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(10, 32), storeValues(store, 10, 0))
+		storageTrie.Commit()
+		code := []byte(fmt.Sprintf("code %d", i))
+		store.Set(Hasher(code), code)
+		values = append(values, storeContract(store, code, storageTrie.Root, 0))
+		storageRoots = append(storageRoots, storageTrie.Root)
+		codes = append(codes, code)
+	}
+	// an account value that is not a state
+	undecodable := []byte{0xff, 0xff}
+	store.Set(Hasher(undecodable), undecodable)
+	smt := trie.NewTrie(nil, Hasher, store)
+	smt.Update(keys, values)
+	smt.Update(getFreshData(1, 32), [][]byte{Hasher(undecodable)})
+	smt.Commit()
+
+	// corrupt the state: 1 storage trie, 1 contract code and 1 account value
+	store.Delete(storageRoots[0])
+	store.Delete(Hasher(codes[1]))
+	tampered, _ := proto.Marshal(&types.State{Nonce: 1})
+	store.Set(values[0], tampered)
+
+	sa := NewStateAnalysis(store, false, true, true, 8)
+	err := sa.Analyse(smt.Root)
+	if err == nil {
+		t.Fatal("Expected the analysis to fail on the first integrity failure")
+	}
+	sa = NewStateAnalysis(store, false, true, false, 8)
+	sa.CollectIntegrityFailures()
+	err = sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := sa.IntegrityReport(smt.Root)
+	if report.NbFailures[MissingTrieNode] != 1 || report.NbFailures[MissingCode] != 1 ||
+		report.NbFailures[HashMismatch] != 1 || report.NbFailures[UndecodableAccount] != 1 || len(report.Failures) != 4 {
+		t.Fatal("Expected 1 missing node, 1 missing code, 1 hash mismatch and 1 undecodable account, got: ", report.NbFailures)
+	}
+	for _, f := range report.Failures {
+		if len(f.Path) != 256-f.Height {
+			t.Fatal("Expected the key path prefix of the failure, got: ", f.Path, f.Height)
+		}
+		if f.Kind == MissingTrieNode && (!bytes.Equal(f.Hash, storageRoots[0]) || f.Account == nil) {
+			t.Fatal("Expected the missing storage root of a contract")
+		}
+		if f.Kind == HashMismatch && (!bytes.Equal(f.Hash, values[0]) || !bytes.Equal(f.Computed, Hasher(tampered))) {
+			t.Fatal("Expected the hash mismatch of the tampered value")
+		}
+	}
+
+	// a tampered node of the root batch skips its subtree and the traversal continues
+	rootBatch := append([]byte{}, store.Get(smt.Root)...)
+	rootBatch[len(rootBatch)-2] ^= 0xff
+	store.Set(smt.Root, rootBatch)
+	sa = NewStateAnalysis(store, false, true, false, 8)
+	sa.CollectIntegrityFailures()
+	err = sa.Analyse(smt.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = sa.IntegrityReport(smt.Root)
+	if report.NbFailures[HashMismatch] == 0 || sa.Counters.NbUserAccounts == 0 {
+		t.Fatal("Expected a hash mismatch in the root batch and the other accounts to be analysed")
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+func TestTypedErrors(t *testing.T) {
+	store := getDb()
+	keys := getFreshData(100, 32)
+	values := storeStates(store, 100, 0)
+	smt := trie.NewTrie(nil, Hasher, store)
+	smt.Update(keys, values)
+	smt.Commit()
+
+	var notFound *ErrAccountNotFound
+	sa := NewStateAnalysis(store, false, true, true, 1)
+	err := sa.AnalyseAccount(smt.Root, getFreshData(1, 32)[0])
+	if !errors.As(err, &notFound) {
+		t.Fatal("Expected ErrAccountNotFound, got: ", err)
+	}
+	snapStore := db.NewDB(db.BadgerImpl, path.Join(".aergo", "snap"))
+	sa = NewStateAnalysis(store, false, true, true, 1)
+	err = sa.SnapshotAccount(snapStore, smt.Root, keys[0])
+	snapStore.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a missing batch below the root batch is reported with its path
+	batch, err := NewTrieReader(store, false).loadBatch(smt.Root, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var childKey []byte
+	for _, node := range batch[15:] {
+		if len(node) != 0 && node[HashLength] == 0 {
+			childKey = node[:HashLength]
+			break
+		}
+	}
+	if childKey == nil {
+		t.Fatal("Expected a batch below the root batch")
+	}
+	childBatch := store.Get(childKey)
+	store.Delete(childKey)
+	var missingChild *ErrMissingNode
+	sa = NewStateAnalysis(store, false, true, true, 1)
+	err = sa.Analyse(smt.Root)
+	if !errors.As(err, &missingChild) || !bytes.Equal(missingChild.Hash, childKey) || len(missingChild.Path) != 4 {
+		t.Fatal("Expected ErrMissingNode with the path of the batch, got: ", err)
+	}
+	store.Set(childKey, childBatch)
+
+	// a tampered node of the root batch
+	rootBatch := append([]byte{}, store.Get(smt.Root)...)
+	rootBatch[len(rootBatch)-2] ^= 0xff
+	store.Set(smt.Root, rootBatch)
+	var mismatch *ErrHashMismatch
+	sa = NewStateAnalysis(store, false, true, true, 1)
+	err = sa.Analyse(smt.Root)
+	if !errors.As(err, &mismatch) || mismatch.Got == nil || bytes.Equal(mismatch.Expected, mismatch.Got) {
+		t.Fatal("Expected ErrHashMismatch, got: ", err)
+	}
+
+	// a root batch that cannot be decoded
+	store.Set(smt.Root, []byte{1, 2, 3})
+	var undecodable *ErrUndecodableNode
+	keyRange, _ := PrefixRange("0")
+	sa = NewStateAnalysis(store, false, true, true, 1)
+	sa.SetKeyRange(keyRange)
+	err = sa.Analyse(smt.Root)
+	if !errors.As(err, &undecodable) || !bytes.Equal(undecodable.Hash, smt.Root) {
+		t.Fatal("Expected ErrUndecodableNode, got: ", err)
+	}
+
+	// a missing root batch
+	store.Delete(smt.Root)
+	var missing *ErrMissingNode
+	sa = NewStateAnalysis(store, false, true, true, 1)
+	err = sa.Analyse(smt.Root)
+	if !errors.As(err, &missing) || !bytes.Equal(missing.Hash, smt.Root) || missing.Height != 256 {
+		t.Fatal("Expected ErrMissingNode of the root, got: ", err)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestLayers analyses a delta snapshot over the snapshot of its base root without merging them
+func TestLayers(t *testing.T) {
+	store := getDb()
+	keys := getFreshData(200, 32)
+	values := storeStates(store, 200, 0)
+	code := []byte("contract code")
+	store.Set(Hasher(code), code)
+	for i := 0; i < 5; i++ {
+		storageTrie := trie.NewTrie(nil, Hasher, store)
+		storageTrie.Update(getFreshData(10, 32), storeValues(store, 10, 0))
+		storageTrie.Commit()
+		values[i] = storeContract(store, code, storageTrie.Root, 0)
+	}
+	smt := trie.NewTrie(nil, Hasher, store)
+	smt.Update(keys, values)
+	smt.Commit()
+	baseRoot := smt.Root
+	smt.Update(keys[100:110], storeStates(store, 10, 1))
+	smt.Commit()
+	root := smt.Root
+
+	basePath := path.Join(".aergo", "base")
+	deltaPath := path.Join(".aergo", "delta")
+	_ = os.MkdirAll(basePath, 0711)
+	_ = os.MkdirAll(deltaPath, 0711)
+	baseStore := db.NewDB(db.BadgerImpl, basePath)
+	deltaStore := db.NewDB(db.BadgerImpl, deltaPath)
+	err := NewStateAnalysis(store, false, true, false, 8).Snapshot(baseStore, baseRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewStateAnalysis(store, false, true, false, 8).SnapshotDelta(deltaStore, root, baseRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the delta alone doesn't contain the unchanged subtrees
+	err = NewStateAnalysis(deltaStore, false, true, true, 8).Analyse(root)
+	if err == nil {
+		t.Fatal("Expected the delta to miss the unchanged nodes")
+	}
+	expected := NewStateAnalysis(store, false, true, true, 8)
+	err = expected.Analyse(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := NewStateAnalysis(deltaStore, false, true, true, 8)
+	sa.AddLayers(baseStore)
+	err = sa.Analyse(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Counters.NbUserAccounts != expected.Counters.NbUserAccounts || sa.Counters.NbContracts != 5 ||
+		sa.Counters.TotalAerBalance.Cmp(expected.Counters.TotalAerBalance) != 0 {
+		t.Fatal("Expected the layers to contain the whole state, got: ", sa.Counters)
+	}
+	reads := sa.LayerReads()
+	if len(reads) != 2 || reads[0] == 0 || reads[1] == 0 {
+		t.Fatal("Expected reads served by the delta and the base, got: ", reads)
+	}
+	baseStore.Close()
+	deltaStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
 func loadTrieAccounts(smt *trie.Trie, store db.DB, totalAccounts uint, raw []byte) {
 	fmt.Println(totalAccounts)
 	var keys [][]byte
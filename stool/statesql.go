@@ -0,0 +1,60 @@
+package stool
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/aergoio/aergo-lib/db"
+)
+
+// SqlMismatch is a contract whose sql recovery point in the state of a root
+// cannot be restored from the sql database of the contract
+type SqlMismatch struct {
+	Root    []byte
+	Account []byte
+	// RecoveryPoint of the contract in the state of Root
+	RecoveryPoint uint64
+	// DbRecoveryPoint is the number of commits of the master branch of the sql database
+	DbRecoveryPoint uint64
+}
+
+// CheckSqlRecoveryPoints returns the contracts of the states of roots whose sql
+// recovery point cannot be served by their sql database.
+// dbRecoveryPoints maps the trie key of a contract to the number of commits of
+// the master branch of its sql database. Before executing a contract, aergo
+// truncates the branch to the recovery point of the state and fails if the
+// database has less commits (contract/statesql.go restoreRecoveryPoint), so the
+// recovery point of a contract must be between 1 and the number of commits.
+// The contracts not included in the state of a root are skipped.
+func CheckSqlRecoveryPoints(store db.DB, roots [][]byte, dbRecoveryPoints map[Hash]uint64) ([]*SqlMismatch, error) {
+	var accounts []Hash
+	for account := range dbRecoveryPoints {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i][:], accounts[j][:]) < 0
+	})
+	tr := NewTrieReader(store, false)
+	var mismatches []*SqlMismatch
+	for _, root := range roots {
+		for _, account := range accounts {
+			state, err := tr.Get(root, account[:])
+			if err != nil {
+				return nil, err
+			}
+			if state == nil {
+				continue
+			}
+			rp, dbRp := state.GetSqlRecoveryPoint(), dbRecoveryPoints[account]
+			if rp == 0 || rp > dbRp {
+				mismatches = append(mismatches, &SqlMismatch{
+					Root:            root,
+					Account:         append([]byte{}, account[:]...),
+					RecoveryPoint:   rp,
+					DbRecoveryPoint: dbRp,
+				})
+			}
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,72 @@
+package stool
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestCheckSqlRecoveryPoints compares the recovery points of contracts at 2 roots
+// with the number of commits of their sql databases
+func TestCheckSqlRecoveryPoints(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(100, 32)
+	smt.Update(keys, storeStates(store, 100, 0))
+	contracts := getFreshData(4, 32)
+	// contract 1 is ahead of its database at the kept root, contract 2 is created after it
+	smt.Update(contracts[:2], [][]byte{storeSqlContract(store, 2), storeSqlContract(store, 5)})
+	smt.Commit()
+	keptRoot := smt.Root
+	// contract 3 has no recovery point
+	smt.Update(contracts, [][]byte{
+		storeSqlContract(store, 3), storeSqlContract(store, 4), storeSqlContract(store, 1), storeSqlContract(store, 0)})
+	smt.Commit()
+	root := smt.Root
+
+	dbRecoveryPoints := make(map[Hash]uint64)
+	for i, rp := range []uint64{3, 4, 1, 2} {
+		var key Hash
+		copy(key[:], contracts[i])
+		dbRecoveryPoints[key] = rp
+	}
+	mismatches, err := CheckSqlRecoveryPoints(store, [][]byte{root, keptRoot}, dbRecoveryPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 {
+		t.Fatal("Expected 2 recovery point mismatches, got: ", len(mismatches))
+	}
+	for _, m := range mismatches {
+		switch {
+		case bytes.Equal(m.Account, contracts[1]):
+			if !bytes.Equal(m.Root, keptRoot) || m.RecoveryPoint != 5 || m.DbRecoveryPoint != 4 {
+				t.Fatal("Expected the kept root to be ahead of the database, got: ", m)
+			}
+		case bytes.Equal(m.Account, contracts[3]):
+			if !bytes.Equal(m.Root, root) || m.RecoveryPoint != 0 {
+				t.Fatal("Expected the missing recovery point, got: ", m)
+			}
+		default:
+			t.Fatal("Unexpected recovery point mismatch: ", m)
+		}
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// storeSqlContract stores a contract state with a sql recovery point and returns its db key
+func storeSqlContract(store db.DB, rp uint64) []byte {
+	raw, _ := proto.Marshal(&types.State{
+		Nonce:            rp,
+		CodeHash:         Hasher([]byte("sql contract")),
+		SqlRecoveryPoint: rp,
+	})
+	store.Set(Hasher(raw), raw)
+	return Hasher(raw)
+}
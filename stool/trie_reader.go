@@ -1,10 +1,14 @@
 package stool
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
 )
 
 const (
@@ -15,7 +19,11 @@ const (
 // TrieReader provides tools for parsing trie nodes in a db
 // It is a striped down version of the aergo trie package
 type TrieReader struct {
-	db db.DB
+	// layers are the stores read in turn, the first store having a key serves the read
+	layers []db.DB
+	// layerReads counts the reads served by each layer when there are several layers,
+	// it can be shared with the readers of contract storage tries
+	layerReads []uint64
 	// TrieHeight is the number if bits in a key
 	TrieHeight int
 	// LoadDbCounter counts the nb of db reads in on update
@@ -24,27 +32,168 @@ type TrieReader struct {
 	loadDbMux sync.RWMutex
 	// counterOn is used to enable/diseable for efficiency
 	counterOn bool
-	// snapshot is used to copy nodes to the snapshot db
-	snapshot bool
-	// cache trie nodes before writing them to snapshot db
-	snapshotNodes map[Hash][]byte
-	// snapshotLock for snapshot nodes writing
-	snapshotLock sync.RWMutex
+	// snapWriter copies loaded nodes to the snapshot db when not nil
+	snapWriter snapshotSink
+	// checkBatches hashes all the nodes of a loaded batch, including the
+	// nodes that are not traversed, and compares the result with the batch key
+	checkBatches bool
+	// checkSizes only checks that a loaded batch can be decoded
+	checkSizes bool
 }
 
 // NewTrieReader creates a new TrieReader
-func NewTrieReader(store db.DB, countDbReads, snapshot bool) *TrieReader {
+func NewTrieReader(store db.DB, countDbReads bool) *TrieReader {
+	return NewLayeredTrieReader([]db.DB{store}, countDbReads)
+}
+
+// NewLayeredTrieReader creates a TrieReader that reads the stores in order and
+// uses the first one containing a key, like a delta snapshot over its base
+// snapshot or a hot db over a cold archive.
+func NewLayeredTrieReader(stores []db.DB, countDbReads bool) *TrieReader {
 	s := &TrieReader{
 		TrieHeight:    256, // hash any string to get output length
 		counterOn:     countDbReads,
-		db:            store,
+		layers:        stores,
 		LoadDbCounter: 0,
-		snapshot:      snapshot,
-		snapshotNodes: make(map[Hash][]byte),
+	}
+	if len(stores) > 1 {
+		s.layerReads = make([]uint64, len(stores))
 	}
 	return s
 }
 
+// LayerReads returns the number of reads served by each store of a layered
+// TrieReader, or nil if it reads a single store
+func (s *TrieReader) LayerReads() []uint64 {
+	return loadCounters(s.layerReads)
+}
+
+// loadCounters returns a copy of counters incremented atomically
+func loadCounters(counters []uint64) []uint64 {
+	if counters == nil {
+		return nil
+	}
+	values := make([]uint64, len(counters))
+	for i := range counters {
+		values[i] = atomic.LoadUint64(&counters[i])
+	}
+	return values
+}
+
+// dbGetBatch reads a batch of trie nodes in the first layer containing it.
+// A stored batch is never empty so an empty read means the layer doesn't contain it.
+func (s *TrieReader) dbGetBatch(key []byte) []byte {
+	if len(s.layers) == 1 {
+		return s.layers[0].Get(key)
+	}
+	for i, store := range s.layers {
+		if raw := store.Get(key); len(raw) != 0 {
+			atomic.AddUint64(&s.layerReads[i], 1)
+			return raw
+		}
+	}
+	return nil
+}
+
+// dbGet reads a value or code in the first layer containing it
+func (s *TrieReader) dbGet(key []byte) []byte {
+	if len(s.layers) == 1 {
+		return s.layers[0].Get(key)
+	}
+	for i, store := range s.layers {
+		// nil objects are stored as empty values
+		if raw := store.Get(key); len(raw) != 0 || store.Exist(key) {
+			atomic.AddUint64(&s.layerReads[i], 1)
+			return raw
+		}
+	}
+	return nil
+}
+
+// dbExist returns true if a layer contains key
+func (s *TrieReader) dbExist(key []byte) bool {
+	for _, store := range s.layers {
+		if store.Exist(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get fetches the account state of trieKey in the trie of given root.
+// Returns nil if the account is not included in the trie.
+func (s *TrieReader) Get(root, trieKey []byte) (*types.State, error) {
+	valueKey, height, err := s.get(root, trieKey, nil, 0, s.TrieHeight)
+	if err != nil {
+		return nil, err
+	}
+	if valueKey == nil {
+		return nil, nil
+	}
+	return s.loadState(valueKey, height)
+}
+
+// loadState fetches and decodes the account state stored at valueKey
+// referenced by a leaf at height
+func (s *TrieReader) loadState(valueKey []byte, height int) (*types.State, error) {
+	raw := s.dbGet(valueKey)
+	if len(raw) == 0 && !s.dbExist(valueKey) {
+		return nil, &ErrMissingNode{Hash: valueKey, Height: height}
+	}
+	data := &types.State{}
+	// a 0 nonce and 0 balance account is stored as an empty value
+	if len(raw) != 0 {
+		err := proto.Unmarshal(raw, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// GetStorageValue fetches the raw value of trieKey in the contract storage trie of given root.
+// Returns nil if the key is not included in the trie.
+func (s *TrieReader) GetStorageValue(root, trieKey []byte) ([]byte, error) {
+	valueKey, height, err := s.get(root, trieKey, nil, 0, s.TrieHeight)
+	if err != nil {
+		return nil, err
+	}
+	if valueKey == nil {
+		return nil, nil
+	}
+	raw := s.dbGet(valueKey)
+	if len(raw) == 0 {
+		return nil, &ErrMissingNode{Hash: valueKey, Height: height}
+	}
+	return raw, nil
+}
+
+// get follows the key path down to the shortcut leaf and returns
+// the db key of the value stored in the leaf and the height of the leaf.
+func (s *TrieReader) get(root, key []byte, batch [][]byte, iBatch, height int) ([]byte, int, error) {
+	if len(root) == 0 {
+		// the trie does not contain the key
+		return nil, 0, nil
+	}
+	batch, iBatch, lnode, rnode, isShortcut, err := s.LoadChildren(root, height, iBatch, batch)
+	if err != nil {
+		// the path of the node is the beginning of the key
+		setErrPath(err, pathBits(key, s.TrieHeight-height))
+		return nil, 0, err
+	}
+	if isShortcut {
+		if bytes.Equal(lnode[:HashLength], key) {
+			return rnode[:HashLength], height, nil
+		}
+		// another key is on the path so the key is not included
+		return nil, 0, nil
+	}
+	if bitIsSet(key, s.TrieHeight-height) {
+		return s.get(rnode, key, batch, 2*iBatch+2, height-1)
+	}
+	return s.get(lnode, key, batch, 2*iBatch+1, height-1)
+}
+
 // LoadChildren looks for the children of a node.
 // if the node is not stored in cache, it will be loaded from db.
 func (s *TrieReader) LoadChildren(root []byte, height, iBatch int, batch [][]byte) ([][]byte, int, []byte, []byte, bool, error) {
@@ -57,10 +206,19 @@ func (s *TrieReader) LoadChildren(root []byte, height, iBatch int, batch [][]byt
 			batch[0] = []byte{0}
 		} else {
 			var err error
-			batch, err = s.loadBatch(root)
+			batch, err = s.loadBatch(root, height)
 			if err != nil {
 				return nil, 0, nil, nil, false, err
 			}
+			if s.checkBatches {
+				h := hashBatchNode(batch, 0, height)
+				if h == nil {
+					return nil, 0, nil, nil, false, &ErrUndecodableNode{Hash: root[:HashLength], Height: height}
+				}
+				if !bytes.Equal(root[:HashLength], h) {
+					return nil, 0, nil, nil, false, &ErrHashMismatch{Expected: root[:HashLength], Got: h, Height: height}
+				}
+			}
 		}
 		iBatch = 0
 		if batch[0][0] == 1 {
@@ -75,9 +233,9 @@ func (s *TrieReader) LoadChildren(root []byte, height, iBatch int, batch [][]byt
 }
 
 // loadBatch fetches a batch of nodes in cache or db
-func (s *TrieReader) loadBatch(root []byte) ([][]byte, error) {
+func (s *TrieReader) loadBatch(root []byte, height int) ([][]byte, error) {
 	//Fetch node in disk database
-	if s.db == nil {
+	if len(s.layers) == 0 {
 		return nil, fmt.Errorf("DB not connected to trie")
 	}
 	if s.counterOn {
@@ -85,22 +243,25 @@ func (s *TrieReader) loadBatch(root []byte) ([][]byte, error) {
 		s.LoadDbCounter++
 		s.loadDbMux.Unlock()
 	}
-	dbval := s.db.Get(root[:HashLength])
+	dbval := s.dbGetBatch(root[:HashLength])
 
-	if s.snapshot {
-		// snapshot shortcut node
-		var dbkey Hash
-		copy(dbkey[:], root[:HashLength])
-		s.snapshotLock.Lock()
-		s.snapshotNodes[dbkey] = dbval
-		s.snapshotLock.Unlock()
+	if s.snapWriter != nil {
+		// snapshot batch node
+		s.snapWriter.setTrieNode(root[:HashLength], dbval)
 	}
 
 	nodeSize := len(dbval)
 	if nodeSize != 0 {
+		if (s.checkBatches || s.checkSizes) && !validBatchSize(dbval) {
+			return nil, &ErrUndecodableNode{Hash: root[:HashLength], Height: height}
+		}
 		return s.parseBatch(dbval), nil
 	}
-	return nil, fmt.Errorf("the trie node %x is unavailable in the disk db, db may be corrupted", root)
+	if s.checkSizes && s.dbExist(root[:HashLength]) {
+		// a stored batch is never empty
+		return nil, &ErrUndecodableNode{Hash: root[:HashLength], Height: height}
+	}
+	return nil, &ErrMissingNode{Hash: root[:HashLength], Height: height}
 }
 
 // parseBatch decodes the byte data into a slice of nodes and bitmap
@@ -125,6 +286,57 @@ func (s *TrieReader) parseBatch(val []byte) [][]byte {
 	return batch
 }
 
+// hashBatchNode hashes the node at index i of a batch loaded at height.
+// The nodes at the bottom of the batch are the roots of other batches and are not hashed.
+// Returns nil for a default node or if a node doesn't match its hash.
+func hashBatchNode(batch [][]byte, i, height int) []byte {
+	node := batch[i]
+	if len(node) == 0 || (i != 0 && len(node) != HashLength+1) {
+		return nil
+	}
+	if 2*i+2 >= len(batch) {
+		return node[:HashLength]
+	}
+	// the root of a batch only holds the shortcut flag
+	isShortcut := (i == 0 && node[0] == 1) || (i != 0 && node[HashLength] == 1)
+	var h []byte
+	if isShortcut {
+		if len(batch[2*i+1]) < HashLength || len(batch[2*i+2]) < HashLength {
+			return nil
+		}
+		h = hashShortcut(batch[2*i+1], batch[2*i+2], height)
+	} else {
+		lnode := hashBatchNode(batch, 2*i+1, height-1)
+		rnode := hashBatchNode(batch, 2*i+2, height-1)
+		if (lnode == nil && len(batch[2*i+1]) != 0) || (rnode == nil && len(batch[2*i+2]) != 0) {
+			return nil
+		}
+		h = hashNode(lnode, rnode)
+	}
+	if i != 0 && !bytes.Equal(h, node[:HashLength]) {
+		return nil
+	}
+	return h
+}
+
+// validBatchSize returns true if the size of a serialized batch matches its bitmap
+func validBatchSize(val []byte) bool {
+	if len(val) < 4 {
+		return false
+	}
+	if bitIsSet(val, 31) && !(bitIsSet(val, 0) && bitIsSet(val, 1)) {
+		// the key and value of a shortcut batch root are the first nodes
+		return false
+	}
+	nbNodes := 0
+	for i := 0; i < 30; i++ {
+		if bitIsSet(val, i) {
+			nbNodes++
+		}
+	}
+	return len(val) == 4+33*nbNodes
+}
+
 func bitIsSet(bits []byte, i int) bool {
 	return bits[i/8]&(1<<uint(7-i%8)) != 0
 }
@@ -132,3 +344,7 @@ func bitIsSet(bits []byte, i int) bool {
 func bitSet(bits []byte, i int) {
 	bits[i/8] |= 1 << uint(7-i%8)
 }
+
+func bitUnset(bits []byte, i int) {
+	bits[i/8] &^= 1 << uint(7-i%8)
+}
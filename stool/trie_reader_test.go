@@ -0,0 +1,129 @@
+package stool
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/aergoio/aergo/types"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestGet queries included and non included accounts in a trie
+func TestGet(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(100, 32)
+	dbKeys := getFreshData(100, 32)
+	smt.Update(keys, dbKeys)
+	smt.Commit()
+
+	txn := store.NewTx()
+	for i, dbKey := range dbKeys {
+		raw, _ := proto.Marshal(&types.State{
+			Nonce:   uint64(i),
+			Balance: new(big.Int).SetUint64(uint64(i)).Bytes(),
+		})
+		(txn).Set(dbKey, raw)
+	}
+	txn.(db.Transaction).Commit()
+
+	tr := NewTrieReader(store, true)
+	for i, key := range keys {
+		state, err := tr.Get(smt.Root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == nil {
+			t.Fatal("Expected to find the account in the trie")
+		}
+		if state.GetNonce() != uint64(i) || !bytes.Equal(state.GetBalance(), new(big.Int).SetUint64(uint64(i)).Bytes()) {
+			t.Fatal("Wrong account state: ", state)
+		}
+	}
+	state, err := tr.Get(smt.Root, getFreshData(1, 32)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Fatal("Expected non included account to be nil, got: ", state)
+	}
+	// a lost account value is not a 0 nonce and 0 balance account
+	store.Delete(dbKeys[0])
+	_, err = tr.Get(smt.Root, keys[0])
+	if e, ok := err.(*ErrMissingNode); !ok || !bytes.Equal(e.Hash, dbKeys[0]) {
+		t.Fatal("Expected the missing account value to be reported, got: ", err)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestGetStorageValue queries raw values in a contract storage trie
+func TestGetStorageValue(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	key := Hasher([]byte("_sv_owner"))
+	value := []byte(`"AmPNYHyzyh9zweLwDyuoiUuTVCdrdksxkRWDjVJS76WQLExa2Jr4"`)
+	dbKey := Hasher(value)
+	smt.Update([][]byte{key}, [][]byte{dbKey})
+	smt.Commit()
+	store.Set(dbKey, value)
+
+	tr := NewTrieReader(store, false)
+	raw, err := tr.GetStorageValue(smt.Root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, value) {
+		t.Fatal("Wrong storage value: ", string(raw))
+	}
+	raw, err = tr.GetStorageValue(smt.Root, Hasher([]byte("_sv_other")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != nil {
+		t.Fatal("Expected non included key to be nil, got: ", raw)
+	}
+	store.Close()
+	os.RemoveAll(".aergo")
+}
+
+// TestLayeredTrieReader reads the trie nodes and the values in different stores
+func TestLayeredTrieReader(t *testing.T) {
+	store := getDb()
+	smt := trie.NewTrie(nil, Hasher, store)
+	keys := getFreshData(100, 32)
+	valuesPath := path.Join(".aergo", "values")
+	_ = os.MkdirAll(valuesPath, 0711)
+	valuesStore := db.NewDB(db.BadgerImpl, valuesPath)
+	dbKeys := storeStates(valuesStore, 100, 1)
+	smt.Update(keys, dbKeys)
+	smt.Commit()
+
+	tr := NewTrieReader(valuesStore, false)
+	_, err := tr.Get(smt.Root, keys[0])
+	if err == nil {
+		t.Fatal("Expected the trie nodes to be missing from the values store")
+	}
+	tr = NewLayeredTrieReader([]db.DB{valuesStore, store}, false)
+	for _, key := range keys {
+		state, err := tr.Get(smt.Root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == nil || state.GetNonce() != 1 {
+			t.Fatal("Wrong account state: ", state)
+		}
+	}
+	reads := tr.LayerReads()
+	if len(reads) != 2 || reads[0] != 100 || reads[1] == 0 {
+		t.Fatal("Expected the values read in the first layer and the trie nodes in the second, got: ", reads)
+	}
+	valuesStore.Close()
+	store.Close()
+	os.RemoveAll(".aergo")
+}
@@ -0,0 +1,25 @@
+package stool
+
+// Leaf is a shortcut node visited during the trie traversal
+type Leaf struct {
+	// TrieKey is the key of the leaf in the trie (account id or hashed storage key)
+	TrieKey []byte
+	// ValueHash is the db key of the value
+	ValueHash []byte
+	// Value is the raw value stored in the db
+	Value []byte
+	// Height of the leaf in the trie
+	Height int
+	// Account is the trie key of the contract owning a storage leaf, nil for account leaves
+	Account []byte
+}
+
+// LeafVisitor is implemented by custom analyses plugged into StateAnalysis.
+// Visit functions are called concurrently by the traversal threads
+// and returning an error stops the traversal.
+type LeafVisitor interface {
+	// VisitAccount is called for each account leaf of the general trie
+	VisitAccount(leaf *Leaf) error
+	// VisitStorage is called for each leaf of a contract storage trie
+	VisitStorage(leaf *Leaf) error
+}
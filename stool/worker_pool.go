@@ -0,0 +1,84 @@
+package stool
+
+import (
+	"sync"
+)
+
+// workerPool runs trie traversal tasks on a fixed number of goroutines
+type workerPool struct {
+	tasks chan func()
+}
+
+// newWorkerPool starts workers goroutines that run the queued tasks
+func newWorkerPool(workers uint) *workerPool {
+	if workers == 0 {
+		workers = 1
+	}
+	p := &workerPool{
+		// a small queue per worker keeps workers busy between submissions
+		tasks: make(chan func(), 4*workers),
+	}
+	for i := uint(0); i < workers; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// trySubmit queues task if the queue is not full and returns false otherwise
+// so that the caller runs it inline.
+func (p *workerPool) trySubmit(task func()) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// helpUntil runs queued tasks until done is closed.
+// Waiting goroutines help instead of blocking so that a task can wait for
+// the subtasks it queued (contract storage tries) without deadlocking the pool.
+func (p *workerPool) helpUntil(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case task, ok := <-p.tasks:
+			if !ok {
+				<-done
+				return
+			}
+			task()
+		}
+	}
+}
+
+// stop terminates the workers once the queue is empty
+func (p *workerPool) stop() {
+	close(p.tasks)
+}
+
+// traversal tracks the subtrees queued by a Dfs and its first error
+type traversal struct {
+	pending sync.WaitGroup
+	errLock sync.Mutex
+	err     error
+}
+
+func (t *traversal) setErr(err error) {
+	t.errLock.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.errLock.Unlock()
+}
+
+func (t *traversal) getErr() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.err
+}